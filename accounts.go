@@ -0,0 +1,277 @@
+package main
+
+import (
+	"cgl.tideland.biz/applog"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"net/url"
+	"strings"
+)
+
+// Forgotten passwords are reset, and email addresses verified, by mailing a
+// link holding a random token. Tokens expire after the configured time and
+// can only be used once. Only a hash of each token is stored.
+
+const (
+	accountTokenReset     = "reset"
+	accountTokenVerify    = "verify"
+	accountTokenTOTPLogin = "totplogin"
+)
+
+var (
+	ErrInvalidAccountToken = errors.New("This link is invalid or has expired")
+	ErrNoEmail             = errors.New("Profile has no email address")
+)
+
+func accountTokenKey(kind string, token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return redisKey("accounttoken", kind, hex.EncodeToString(hash[:]))
+}
+
+func verifiedEmailKey() string {
+	return redisKey("verifiedemail")
+}
+
+// issueAccountToken returns a new token of the given kind for pid and email
+// that lasts for expiry seconds
+func issueAccountToken(kind string, pid datastore.PidType, email string, expiry int) (string, error) {
+	token := randomString(24)
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HMSET", accountTokenKey(kind, token), "pid", pid, "email", email)
+	conn.Send("EXPIRE", accountTokenKey(kind, token), expiry)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeAccountToken returns the pid and email a token was issued for and
+// removes it so it cannot be used again
+func consumeAccountToken(kind string, token string) (datastore.PidType, string, error) {
+	if token == "" {
+		return "", "", ErrInvalidAccountToken
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HGETALL", accountTokenKey(kind, token))
+	conn.Send("DEL", accountTokenKey(kind, token))
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return "", "", err
+	}
+
+	values, err := redis.StringMap(replies[0], nil)
+	if err != nil {
+		return "", "", err
+	}
+	if values["pid"] == "" {
+		return "", "", ErrInvalidAccountToken
+	}
+	return datastore.PidType(values["pid"]), values["email"], nil
+}
+
+func resetRequestsKey(kind string, id string) string {
+	return redisKey("resetrequests", kind, id)
+}
+
+// accountLink returns the address of path on the configured base URL, or on
+// this host when none is configured
+func accountLink(path string, token string) string {
+	base := strings.TrimRight(config.Mail.BaseURL, "/")
+	if base == "" {
+		scheme := "http"
+		if config.Web.Session.Secure {
+			scheme = "https"
+		}
+		base = fmt.Sprintf("%s://%s", scheme, Hostname())
+	}
+	return fmt.Sprintf("%s%s?token=%s", base, path, url.QueryEscape(token))
+}
+
+// allowResetRequest counts a password reset request for pid from ip and
+// reports whether both are within their configured limits. Requests are
+// counted for pids whether or not the profile exists.
+func allowResetRequest(pid datastore.PidType, ip string) (bool, error) {
+	c := config.Mail
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("INCR", resetRequestsKey("pid", string(pid)))
+	conn.Send("EXPIRE", resetRequestsKey("pid", string(pid)), c.ResetWindow)
+	conn.Send("INCR", resetRequestsKey("ip", ip))
+	conn.Send("EXPIRE", resetRequestsKey("ip", ip), c.ResetWindow)
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+
+	pidRequests, err := redis.Int(replies[0], nil)
+	if err != nil {
+		return false, err
+	}
+	ipRequests, err := redis.Int(replies[2], nil)
+	if err != nil {
+		return false, err
+	}
+	return pidRequests <= c.ResetPidMax && ipRequests <= c.ResetIPMax, nil
+}
+
+// RequestPasswordReset mails a password reset link to the address of pid.
+// Nothing is sent if the profile does not exist or has no address.
+func RequestPasswordReset(pid datastore.PidType) error {
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	profile, err := s.Profile(pid)
+	if err != nil || profile.Email == "" {
+		applog.Infof("Password reset requested for %s which has no email address", pid)
+		return nil
+	}
+
+	token, err := issueAccountToken(accountTokenReset, pid, profile.Email, config.Mail.ResetExpiry)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("A password reset was requested for %s.\n\nTo choose a new password visit:\n\n%s\n\nThe link can be used once in the next %d minutes. If you did not ask to reset your password you can ignore this message.",
+		pid, accountLink("/-resetpassword", token), config.Mail.ResetExpiry/60)
+
+	return mailer.Send(profile.Email, "Reset your password", body)
+}
+
+// ResetPassword sets the password of the profile a reset token was issued for
+// and ends all of its sessions
+func ResetPassword(token string, pwd string) (datastore.PidType, error) {
+	pid, _, err := consumeAccountToken(accountTokenReset, token)
+	if err != nil {
+		return "", err
+	}
+
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	if err := s.UpdateProfile(pid, map[string]string{"pwd": pwd}); err != nil {
+		return "", err
+	}
+
+	if err := RevokeSessions(pid); err != nil {
+		applog.Errorf("Could not revoke sessions of %s: %s", pid, err.Error())
+	}
+	applog.Infof("Password reset for %s", pid)
+	return pid, nil
+}
+
+// SendEmailVerification mails a link to the address of pid that confirms the
+// address belongs to it
+func SendEmailVerification(pid datastore.PidType) error {
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	profile, err := s.Profile(pid)
+	if err != nil {
+		return err
+	}
+	if profile.Email == "" {
+		return ErrNoEmail
+	}
+
+	token, err := issueAccountToken(accountTokenVerify, pid, profile.Email, config.Mail.VerifyExpiry)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Please confirm that this is the email address for %s by visiting:\n\n%s\n\nIf you did not add this address to a profile you can ignore this message.",
+		pid, accountLink("/-verifyemail", token))
+
+	return mailer.Send(profile.Email, "Confirm your email address", body)
+}
+
+// VerifyEmail records that the address a verification token was sent to
+// belongs to its profile, as long as the profile still has that address
+func VerifyEmail(token string) (datastore.PidType, error) {
+	pid, email, err := consumeAccountToken(accountTokenVerify, token)
+	if err != nil {
+		return "", err
+	}
+
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	profile, err := s.Profile(pid)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(profile.Email, email) {
+		return "", ErrInvalidAccountToken
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("HSET", verifiedEmailKey(), pid, strings.ToLower(email)); err != nil {
+		return "", err
+	}
+	return pid, nil
+}
+
+// EmailVerified reports whether email has been verified as the address of
+// pid
+func EmailVerified(pid datastore.PidType, email string) (bool, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	verified, err := redis.String(conn.Do("HGET", verifiedEmailKey(), pid))
+	if err != nil {
+		if err == redis.ErrNil {
+			return false, nil
+		}
+		return false, err
+	}
+	return email != "" && verified == strings.ToLower(email), nil
+}
+
+// forgetVerifiedEmail removes the record of the verified address of pid
+func forgetVerifiedEmail(pid datastore.PidType) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HDEL", verifiedEmailKey(), pid)
+	return err
+}
+
+func clearAccountTokens() error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("KEYS", redisKey("accounttoken", "*")))
+	if err != nil {
+		return err
+	}
+
+	limits, err := redis.Strings(conn.Do("KEYS", redisKey("resetrequests", "*")))
+	if err != nil {
+		return err
+	}
+	keys = append(keys, limits...)
+
+	conn.Send("MULTI")
+	for _, key := range keys {
+		conn.Send("DEL", key)
+	}
+	conn.Send("DEL", verifiedEmailKey())
+	_, err = conn.Do("EXEC")
+	return err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"cgl.tideland.biz/applog"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"sort"
+	"time"
+)
+
+// Every search is recorded in a sorted set scored by the time it was made.
+// Each item returned by a provider search is linked to the search for a
+// while so that the searcher promoting the item can be credited to the
+// search. Records
+// older than the retention period are discarded.
+
+// Most queries listed in each part of a search report
+const maxReportQueries = 100
+
+type SearchRecord struct {
+	Id        string            `json:"id"`
+	Query     string            `json:"query"`
+	Type      string            `json:"type"`
+	Pid       datastore.PidType `json:"pid"`
+	Providers map[string]int    `json:"providers,omitempty"` // number of results from each provider
+	Results   int               `json:"results"`
+	Latency   float64           `json:"latency"` // milliseconds
+	Ts        int64             `json:"ts"`
+}
+
+// PromotionRecord records an item from a search's results being promoted
+type PromotionRecord struct {
+	SearchId string               `json:"searchid"`
+	Query    string               `json:"query"`
+	Type     string               `json:"type"`
+	Pid      datastore.PidType    `json:"pid"`
+	ItemId   datastore.ItemIdType `json:"itemid"`
+	Ts       int64                `json:"ts"`
+}
+
+// QueryStats summarises the searches made for a single query
+type QueryStats struct {
+	Query      string  `json:"query"`
+	Searches   int     `json:"searches"`
+	Results    float64 `json:"results"` // average number of results
+	Latency    float64 `json:"latency"` // average milliseconds
+	Promotions int     `json:"promotions"`
+	Conversion float64 `json:"conversion"` // proportion of searches followed by a promotion
+}
+
+// SearchReport summarises the searches made in a time window
+type SearchReport struct {
+	From              time.Time     `json:"from"`
+	To                time.Time     `json:"to"`
+	Searches          int           `json:"searches"`
+	ZeroResults       int           `json:"zeroresults"`
+	Promotions        int           `json:"promotions"`
+	ConvertedSearches int           `json:"convertedsearches"`
+	Conversion        float64       `json:"conversion"`
+	TopQueries        []*QueryStats `json:"topqueries,omitempty"`
+	ZeroResultQueries []*QueryStats `json:"zeroresultqueries,omitempty"`
+}
+
+func searchRecordsKey() string {
+	return redisKey("analytics", "searches")
+}
+
+func promotionRecordsKey() string {
+	return redisKey("analytics", "promotions")
+}
+
+func searchResultKey(pid datastore.PidType, id datastore.ItemIdType) string {
+	return redisKey("analytics", "result", string(pid), string(id))
+}
+
+// recordSearchQuery records a search made by pid and links the ids of the
+// items it returned to it
+func recordSearchQuery(srch string, stype string, pid datastore.PidType, result SearchResults, latency time.Duration, ids []datastore.ItemIdType) {
+	now := time.Now()
+
+	rec := &SearchRecord{
+		Id:      randomString(9),
+		Query:   normalizeSearch(srch),
+		Type:    stype,
+		Pid:     pid,
+		Results: searchResultCount(result.Results),
+		Latency: float64(latency) / float64(time.Millisecond),
+		Ts:      now.Unix(),
+	}
+
+	if len(result.Providers) > 0 {
+		rec.Providers = make(map[string]int, len(result.Providers))
+		for _, p := range result.Providers {
+			rec.Providers[p.Name] = p.Count
+		}
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		applog.Errorf("Could not record search: %s", err.Error())
+		return
+	}
+
+	link, err := json.Marshal(&PromotionRecord{SearchId: rec.Id, Query: rec.Query, Type: rec.Type})
+	if err != nil {
+		applog.Errorf("Could not record search: %s", err.Error())
+		return
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	expired := now.Add(-time.Duration(config.Search.Analytics.Retention) * 24 * time.Hour).Unix()
+
+	conn.Send("MULTI")
+	conn.Send("ZADD", searchRecordsKey(), rec.Ts, data)
+	conn.Send("ZREMRANGEBYSCORE", searchRecordsKey(), "-inf", expired)
+	conn.Send("ZREMRANGEBYSCORE", promotionRecordsKey(), "-inf", expired)
+	for _, id := range ids {
+		conn.Send("SET", searchResultKey(pid, id), link, "EX", config.Search.Analytics.PromotionWindow)
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		applog.Errorf("Could not record search: %s", err.Error())
+	}
+}
+
+// recordPromotion credits the promotion of an item by pid to the search
+// made by pid that returned it, if any
+func recordPromotion(pid datastore.PidType, id datastore.ItemIdType) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	link, err := redis.Bytes(conn.Do("GET", searchResultKey(pid, id)))
+	if err != nil {
+		if err != redis.ErrNil {
+			applog.Errorf("Could not record promotion of %s: %s", id, err.Error())
+		}
+		return
+	}
+
+	rec := &PromotionRecord{}
+	if err := json.Unmarshal(link, rec); err != nil {
+		applog.Errorf("Could not record promotion of %s: %s", id, err.Error())
+		return
+	}
+	rec.Pid = pid
+	rec.ItemId = id
+	rec.Ts = time.Now().Unix()
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		applog.Errorf("Could not record promotion of %s: %s", id, err.Error())
+		return
+	}
+
+	if _, err := conn.Do("ZADD", promotionRecordsKey(), rec.Ts, data); err != nil {
+		applog.Errorf("Could not record promotion of %s: %s", id, err.Error())
+	}
+}
+
+func searchResultCount(results interface{}) int {
+	switch r := results.(type) {
+	case []*datastore.Profile:
+		return len(r)
+	case ProfileSearchResults:
+		return len(r)
+	case ItemSearchResults:
+		return len(r)
+	case FormattedItemSearchResults:
+		return len(r)
+	}
+	return 0
+}
+
+// SearchAnalytics reports on the searches made between from and to, listing
+// at most limit queries in each list
+func SearchAnalytics(from time.Time, to time.Time, limit int) (*SearchReport, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	searches, err := redis.Strings(conn.Do("ZRANGEBYSCORE", searchRecordsKey(), from.Unix(), to.Unix()))
+	if err != nil {
+		return nil, err
+	}
+
+	promotions, err := redis.Strings(conn.Do("ZRANGEBYSCORE", promotionRecordsKey(), from.Unix(), to.Unix()))
+	if err != nil {
+		return nil, err
+	}
+
+	report := &SearchReport{From: from, To: to}
+
+	converted := make(map[string]bool)
+	queryPromotions := make(map[string]int)
+	for _, v := range promotions {
+		rec := &PromotionRecord{}
+		if err := json.Unmarshal([]byte(v), rec); err != nil {
+			continue
+		}
+		report.Promotions++
+		queryPromotions[rec.Query]++
+		converted[rec.SearchId] = true
+	}
+
+	queries := make(map[string]*QueryStats)
+	queryConverted := make(map[string]int)
+	for _, v := range searches {
+		rec := &SearchRecord{}
+		if err := json.Unmarshal([]byte(v), rec); err != nil {
+			continue
+		}
+
+		report.Searches++
+		if rec.Results == 0 {
+			report.ZeroResults++
+		}
+		if converted[rec.Id] {
+			report.ConvertedSearches++
+			queryConverted[rec.Query]++
+		}
+
+		qs, exists := queries[rec.Query]
+		if !exists {
+			qs = &QueryStats{Query: rec.Query}
+			queries[rec.Query] = qs
+		}
+		qs.Searches++
+		qs.Results += float64(rec.Results)
+		qs.Latency += rec.Latency
+	}
+
+	if report.Searches > 0 {
+		report.Conversion = float64(report.ConvertedSearches) / float64(report.Searches)
+	}
+
+	all := make([]*QueryStats, 0, len(queries))
+	zero := make([]*QueryStats, 0)
+	for _, qs := range queries {
+		if qs.Results == 0 {
+			zero = append(zero, qs)
+		}
+		qs.Promotions = queryPromotions[qs.Query]
+		qs.Conversion = float64(queryConverted[qs.Query]) / float64(qs.Searches)
+		qs.Results /= float64(qs.Searches)
+		qs.Latency /= float64(qs.Searches)
+		all = append(all, qs)
+	}
+
+	report.TopQueries = topQueries(all, limit)
+	report.ZeroResultQueries = topQueries(zero, limit)
+	return report, nil
+}
+
+// topQueries returns the limit most searched for queries
+func topQueries(list []*QueryStats, limit int) []*QueryStats {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Searches != list[j].Searches {
+			return list[i].Searches > list[j].Searches
+		}
+		return list[i].Query < list[j].Query
+	})
+
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
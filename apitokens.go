@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Personal API tokens let scripts act for a profile without logging in. A
+// token is sent in an "Authorization: Bearer" header and is only accepted by
+// handlers registered with one of its scopes. Only a hash of the secret part
+// of each token is stored so tokens cannot be recovered from redis.
+
+const (
+	ScopeReadTimeline  = "read-timeline"
+	ScopeAddItems      = "add-items"
+	ScopeManageFollows = "manage-follows"
+)
+
+var apiTokenScopes = []string{ScopeReadTimeline, ScopeAddItems, ScopeManageFollows}
+
+// Most tokens a profile may have at once
+const maxAPITokens = 20
+
+var ErrAPITokenNotFound = errors.New("API token not found")
+
+type APIToken struct {
+	Id       string            `json:"id"`
+	Pid      datastore.PidType `json:"pid"`
+	Name     string            `json:"name"`
+	Scopes   []string          `json:"scopes"`
+	Created  int64             `json:"created"`
+	LastUsed int64             `json:"lastused"`
+
+	// Token is only set when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func apiTokenKey(id string) string {
+	return redisKey("apitoken", id)
+}
+
+func profileAPITokensKey(pid datastore.PidType) string {
+	return redisKey("apitokens", string(pid))
+}
+
+func hashAPITokenSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// CreateAPIToken issues a new token for pid with the given scopes. The
+// returned token is the only time its value is available.
+func CreateAPIToken(pid datastore.PidType, name string, scopes []string) (*APIToken, error) {
+	if len(scopes) == 0 {
+		return nil, errors.New("At least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !isAPITokenScope(scope) {
+			return nil, fmt.Errorf("Unknown scope %s", scope)
+		}
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	count, err := redis.Int(conn.Do("SCARD", profileAPITokensKey(pid)))
+	if err != nil {
+		return nil, err
+	}
+	if count >= maxAPITokens {
+		return nil, fmt.Errorf("A profile may only have %d API tokens", maxAPITokens)
+	}
+
+	id := randomString(9)
+	secret := randomString(30)
+	now := time.Now().Unix()
+
+	conn.Send("MULTI")
+	conn.Send("HMSET", apiTokenKey(id), "pid", pid, "name", name, "scopes", strings.Join(scopes, ","), "hash", hashAPITokenSecret(secret), "created", now, "lastused", 0)
+	conn.Send("SADD", profileAPITokensKey(pid), id)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return nil, err
+	}
+
+	return &APIToken{
+		Id:      id,
+		Pid:     pid,
+		Name:    name,
+		Scopes:  scopes,
+		Created: now,
+		Token:   fmt.Sprintf("pt.%s.%s", id, secret),
+	}, nil
+}
+
+func isAPITokenScope(scope string) bool {
+	for _, s := range apiTokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func readAPIToken(conn redis.Conn, id string) (*APIToken, string, error) {
+	values, err := redis.StringMap(conn.Do("HGETALL", apiTokenKey(id)))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(values) == 0 {
+		return nil, "", ErrAPITokenNotFound
+	}
+
+	created, _ := strconv.ParseInt(values["created"], 10, 64)
+	lastUsed, _ := strconv.ParseInt(values["lastused"], 10, 64)
+
+	return &APIToken{
+		Id:       id,
+		Pid:      datastore.PidType(values["pid"]),
+		Name:     values["name"],
+		Scopes:   strings.Split(values["scopes"], ","),
+		Created:  created,
+		LastUsed: lastUsed,
+	}, values["hash"], nil
+}
+
+// APITokens lists the tokens of pid, newest first
+func APITokens(pid datastore.PidType) ([]*APIToken, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("SMEMBERS", profileAPITokensKey(pid)))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*APIToken, 0, len(ids))
+	for _, id := range ids {
+		token, _, err := readAPIToken(conn, id)
+		if err != nil {
+			if err == ErrAPITokenNotFound {
+				continue
+			}
+			return nil, err
+		}
+		list = append(list, token)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created > list[j].Created })
+	return list, nil
+}
+
+// RevokeAPIToken removes one of the tokens of pid
+func RevokeAPIToken(pid datastore.PidType, id string) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	removed, err := redis.Int(conn.Do("SREM", profileAPITokensKey(pid), id))
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrAPITokenNotFound
+	}
+
+	_, err = conn.Do("DEL", apiTokenKey(id))
+	return err
+}
+
+// RevokeAPITokens removes every token of pid
+func RevokeAPITokens(pid datastore.PidType) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("SMEMBERS", profileAPITokensKey(pid)))
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	for _, id := range ids {
+		conn.Send("DEL", apiTokenKey(id))
+	}
+	conn.Send("DEL", profileAPITokensKey(pid))
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func clearAPITokens() error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	for _, pattern := range []string{redisKey("apitoken", "*"), redisKey("apitokens", "*")} {
+		keys, err := redis.Strings(conn.Do("KEYS", pattern))
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if _, err := conn.Do("DEL", key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verifyAPIToken returns the stored token matching value, recording that it
+// has been used. ErrAPITokenNotFound is returned for unknown or malformed
+// tokens.
+func verifyAPIToken(value string) (*APIToken, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 || parts[0] != "pt" {
+		return nil, ErrAPITokenNotFound
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	token, hash, err := readAPIToken(conn, parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashAPITokenSecret(parts[2]))) != 1 {
+		return nil, ErrAPITokenNotFound
+	}
+
+	token.LastUsed = time.Now().Unix()
+	conn.Do("HSET", apiTokenKey(token.Id), "lastused", token.LastUsed)
+	return token, nil
+}
+
+// bearerToken returns the token in the request's Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len("Bearer "):]), true
+}
+
+type scopeContextKey struct{}
+
+// withScope allows requests to handler to be authenticated with API tokens
+// that have scope
+func withScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r.WithContext(context.WithValue(r.Context(), scopeContextKey{}, scope)))
+	}
+}
+
+// checkAPIToken is checkSession for requests authenticated with an API
+// token. Tokens are refused by handlers not registered with withScope.
+func checkAPIToken(w http.ResponseWriter, r *http.Request, value string, silent bool) (bool, datastore.PidType) {
+	token, err := verifyAPIToken(value)
+	if err != nil {
+		if err != ErrAPITokenNotFound {
+			ErrorResponse(w, r, err)
+			return false, datastore.PidType("")
+		}
+		if !silent {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		}
+		return false, datastore.PidType("")
+	}
+
+	scope, _ := r.Context().Value(scopeContextKey{}).(string)
+	if scope == "" {
+		if !silent {
+			http.Error(w, "Forbidden: API tokens cannot be used here", http.StatusForbidden)
+		}
+		return false, datastore.PidType("")
+	}
+	if !token.HasScope(scope) {
+		if !silent {
+			http.Error(w, fmt.Sprintf("Forbidden: API token does not have the %s scope", scope), http.StatusForbidden)
+		}
+		return false, datastore.PidType("")
+	}
+
+	return true, token.Pid
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache is a simple in-memory store whose entries expire after a lifetime.
+// Expired entries may continue to be served for a further stale period while
+// the caller refreshes them in the background.
+type Cache struct {
+	mu        sync.Mutex
+	entries   map[string]*cacheEntry
+	lifetime  time.Duration
+	stale     time.Duration
+	lastSweep time.Time
+}
+
+type cacheEntry struct {
+	value      interface{}
+	stored     time.Time
+	refreshing bool
+}
+
+func NewCache(lifetime time.Duration, stale time.Duration) *Cache {
+	return &Cache{
+		entries:   make(map[string]*cacheEntry),
+		lifetime:  lifetime,
+		stale:     stale,
+		lastSweep: time.Now(),
+	}
+}
+
+// SetLifetime changes the lifetime and stale period of the cache
+func (c *Cache) SetLifetime(lifetime time.Duration, stale time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lifetime = lifetime
+	c.stale = stale
+}
+
+// Get looks up the value stored under key. The refresh result is true when
+// the entry is stale and the caller has been chosen to refresh it; the caller
+// must then call Set or Abandon for the key.
+func (c *Cache) Get(key string) (value interface{}, found bool, refresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, exists := c.entries[key]
+	if !exists {
+		return nil, false, false
+	}
+
+	age := time.Since(entry.stored)
+	if age < c.lifetime {
+		return entry.value, true, false
+	}
+
+	if age >= c.lifetime+c.stale {
+		delete(c.entries, key)
+		return nil, false, false
+	}
+
+	if entry.refreshing {
+		return entry.value, true, false
+	}
+
+	entry.refreshing = true
+	return entry.value, true, true
+}
+
+func (c *Cache) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.entries[key] = &cacheEntry{value: value, stored: now}
+
+	if now.Sub(c.lastSweep) > c.lifetime {
+		c.sweep(now)
+	}
+}
+
+// Abandon gives up a refresh started by Get, leaving the stale entry in place
+// for another caller to refresh
+func (c *Cache) Abandon(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, exists := c.entries[key]; exists {
+		entry.refreshing = false
+	}
+}
+
+// Delete removes the entry stored under key so that the next Get misses
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+// sweep removes entries that are too old to be served. Caller must hold c.mu
+func (c *Cache) sweep(now time.Time) {
+	for key, entry := range c.entries {
+		if now.Sub(entry.stored) >= c.lifetime+c.stale {
+			delete(c.entries, key)
+		}
+	}
+	c.lastSweep = now
+}
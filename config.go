@@ -4,6 +4,8 @@ import (
 	"cgl.tideland.biz/applog"
 	"github.com/BurntSushi/toml"
 	"github.com/placetime/datastore"
+	"net"
+	"net/url"
 	"os"
 	"os/user"
 	"path"
@@ -16,6 +18,8 @@ type Config struct {
 	Search    SearchConfig     `toml:"search"`
 	Twitter   TwitterConfig    `toml:"twitter"`
 	Geo       GeoConfig        `toml:"geo"`
+	Redis     RedisConfig      `toml:"redis"`
+	Mail      MailConfig       `toml:"mail"`
 }
 
 type WebConfig struct {
@@ -23,47 +27,120 @@ type WebConfig struct {
 	Session SessionConfig `toml:"sessionlength"`
 	Path    string        `toml:"path"`
 	Admins  []string      `toml:"admins"`
+	Login   LoginConfig   `toml:"login"`
+
+	// Addresses or CIDR ranges of proxies whose X-Forwarded-For headers
+	// are trusted when limiting logins
+	TrustedProxies []string `toml:"trustedproxies"`
+}
+
+// LoginConfig limits failed logins. A profile or client address is locked
+// out once it reaches its number of failures within the window.
+type LoginConfig struct {
+	Window      int `toml:"window"`      // seconds failed logins are counted for
+	PidFailures int `toml:"pidfailures"` // failures for a profile before it is locked out
+	IPFailures  int `toml:"ipfailures"`  // failures from an address before it is locked out
+	Lockout     int `toml:"lockout"`     // seconds of the first lockout, doubled for each further failure
+	MaxLockout  int `toml:"maxlockout"`  // longest lockout in seconds
 }
 
 type SessionConfig struct {
-	Duration int    `toml:"duration"`
-	Cookie   string `toml:"cookie"`
+	Duration int      `toml:"duration"` // seconds a session lasts without being used
+	Cookie   string   `toml:"cookie"`
+	Keys     []string `toml:"keys"`   // keys used to sign session cookies, newest first
+	Secure   bool     `toml:"secure"` // only send the session cookie over https
 }
 
 type ImageConfig struct {
-	Path string `toml:"path"`
+	Path        string `toml:"path"`
+	Sizes       []int  `toml:"sizes"`     // widths in pixels that mirrored images are scaled to
+	Workers     int    `toml:"workers"`   // number of images mirrored concurrently
+	QueueLength int    `toml:"queue"`     // images waiting to be mirrored before new ones are dropped
+	Timeout     int    `toml:"timeout"`   // milliseconds allowed to download an image
+	MaxBytes    int64  `toml:"maxbytes"`  // largest image that will be downloaded
+	MaxPixels   int64  `toml:"maxpixels"` // largest width times height that will be decoded
 }
 
 type SearchConfig struct {
-	Lifetime int            `toml:"lifetime"`
-	Timeout  int            `toml:"timeout"`
-	Eventful EventfulConfig `toml:"eventful"`
-	Songkick SongkickConfig `toml:"songkick"`
-	Lastfm   LastfmConfig   `toml:"lastm"`
-	Spotify  SpotifyConfig  `toml:"spotify"`
-	Youtube  YoutubeConfig  `toml:"youtube"`
+	Lifetime      int             `toml:"lifetime"`
+	StaleLifetime int             `toml:"stalelifetime"` // seconds a cached search may be served while it is refreshed
+	Timeout       int             `toml:"timeout"`
+	Radius        int             `toml:"radius"` // default kilometres around the searcher's location to find events
+	Eventful      EventfulConfig  `toml:"eventful"`
+	Songkick      SongkickConfig  `toml:"songkick"`
+	Lastfm        LastfmConfig    `toml:"lastm"`
+	Spotify       SpotifyConfig   `toml:"spotify"`
+	Youtube       YoutubeConfig   `toml:"youtube"`
+	Ranking       RankingConfig   `toml:"ranking"`
+	Breaker       BreakerConfig   `toml:"breaker"`
+	Saved         SavedConfig     `toml:"saved"`
+	Analytics     AnalyticsConfig `toml:"analytics"`
+	Fixtures      FixturesConfig  `toml:"fixtures"`
+}
+
+// FixturesConfig controls recording and replaying of search provider
+// responses. Providers use the network normally when Mode is empty.
+type FixturesConfig struct {
+	Mode string `toml:"mode"` // record or replay
+	Path string `toml:"path"` // directory holding fixture files
+}
+
+// AnalyticsConfig controls how long searches are recorded for
+type AnalyticsConfig struct {
+	Retention       int `toml:"retention"`       // days to keep records of searches and promotions
+	PromotionWindow int `toml:"promotionwindow"` // seconds a promotion of a search result is credited to the search
+}
+
+// SavedConfig controls how saved searches are re-run
+type SavedConfig struct {
+	Interval         int `toml:"interval"`         // seconds between runs of each saved search
+	MaxPerProfile    int `toml:"maxperprofile"`    // most searches a profile may save
+	MaxNotifications int `toml:"maxnotifications"` // most notifications kept for a profile
+}
+
+// BreakerConfig controls when failing search providers are skipped
+type BreakerConfig struct {
+	Failures int `toml:"failures"` // consecutive failures before a provider is skipped
+	Cooldown int `toml:"cooldown"` // seconds to skip a provider before trying it again
+}
+
+// RankingConfig weights the parts of the relevance score given to search
+// results. Media and provider weights default to 1 when not listed.
+type RankingConfig struct {
+	TextWeight  float64            `toml:"textweight"`
+	DateWeight  float64            `toml:"dateweight"`
+	MediaWeight float64            `toml:"mediaweight"`
+	Media       map[string]float64 `toml:"media"`
+	Providers   map[string]float64 `toml:"providers"`
 }
 
 type EventfulConfig struct {
-	AppKey string `toml:"appkey"`
-	Pid    string `toml:"pid"`
+	AppKey  string `toml:"appkey"`
+	Pid     string `toml:"pid"`
+	Enabled bool   `toml:"enabled"`
 }
 
 type YoutubeConfig struct {
-	Pid string `toml:"pid"`
+	Pid     string `toml:"pid"`
+	Enabled bool   `toml:"enabled"`
 }
 
 type SpotifyConfig struct {
-	Pid string `toml:"pid"`
+	Pid     string `toml:"pid"`
+	Enabled bool   `toml:"enabled"`
 }
 
 type SongkickConfig struct {
-	AppKey string `toml:"appkey"`
+	AppKey  string `toml:"appkey"`
+	Pid     string `toml:"pid"`
+	Enabled bool   `toml:"enabled"`
 }
 
 type LastfmConfig struct {
-	APIKey string `toml:"apikey"`
-	Secret string `toml:"secret"`
+	APIKey  string `toml:"apikey"`
+	Secret  string `toml:"secret"`
+	Pid     string `toml:"pid"`
+	Enabled bool   `toml:"enabled"`
 }
 
 type TwitterConfig struct {
@@ -71,10 +148,39 @@ type TwitterConfig struct {
 	OAuthConsumerSecret string `toml:"consumersecret"`
 }
 
+// MailConfig chooses how mail to users is sent and how long the links mailed
+// to them last
+type MailConfig struct {
+	Backend      string     `toml:"backend"` // smtp or file
+	From         string     `toml:"from"`
+	Path         string     `toml:"path"`         // directory the file backend writes messages to
+	BaseURL      string     `toml:"baseurl"`      // scheme and host of links in mail, e.g. https://placetime.com
+	ResetExpiry  int        `toml:"resetexpiry"`  // seconds a password reset link can be used
+	VerifyExpiry int        `toml:"verifyexpiry"` // seconds an email verification link can be used
+	ResetWindow  int        `toml:"resetwindow"`  // seconds over which password reset requests are counted
+	ResetPidMax  int        `toml:"resetpidmax"`  // reset requests allowed for a profile within the window
+	ResetIPMax   int        `toml:"resetipmax"`   // reset requests allowed from an address within the window
+	SMTP         SMTPConfig `toml:"smtp"`
+}
+
+type SMTPConfig struct {
+	Address  string `toml:"address"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
 type GeoConfig struct {
 	CityDb string `toml:"citydb"`
 }
 
+// RedisConfig locates the redis database used for data the server keeps
+// outside the datastore. It is normally the same server as the datastore.
+type RedisConfig struct {
+	Address  string `toml:"address"`
+	Database int    `toml:"database"`
+	Prefix   string `toml:"prefix"`
+}
+
 var (
 	DefaultConfig Config = Config{
 		Web: WebConfig{
@@ -85,30 +191,79 @@ var (
 				Duration: 86400 * 14,
 				Cookie:   "ptsession",
 			},
+			Login: LoginConfig{
+				Window:      3600,
+				PidFailures: 5,
+				IPFailures:  50,
+				Lockout:     60,
+				MaxLockout:  3600,
+			},
 		},
 		Image: ImageConfig{
-			Path: "/var/opt/timescroll/img",
+			Path:        "/var/opt/timescroll/img",
+			Sizes:       []int{75, 300},
+			Workers:     4,
+			QueueLength: 256,
+			Timeout:     10000,
+			MaxBytes:    5 * 1024 * 1024,
+			MaxPixels:   4096 * 4096,
 		},
 		Datastore: datastore.DefaultConfig,
 		Search: SearchConfig{
-			Lifetime: 600,
-			Timeout:  15000,
+			Lifetime:      600,
+			StaleLifetime: 3600,
+			Timeout:       15000,
+			Radius:        50,
 			Eventful: EventfulConfig{
-				AppKey: "xxx",
-				Pid:    "eventful",
+				AppKey:  "xxx",
+				Pid:     "eventful",
+				Enabled: true,
 			},
 			Songkick: SongkickConfig{
-				AppKey: "xxx",
+				AppKey:  "xxx",
+				Pid:     "songkick",
+				Enabled: true,
 			},
 			Lastfm: LastfmConfig{
-				APIKey: "xxx",
-				Secret: "xxx",
+				APIKey:  "xxx",
+				Secret:  "xxx",
+				Pid:     "lastfm",
+				Enabled: true,
 			},
 			Youtube: YoutubeConfig{
-				Pid: "youtube",
+				Pid:     "youtube",
+				Enabled: true,
 			},
 			Spotify: SpotifyConfig{
-				Pid: "spotify",
+				Pid:     "spotify",
+				Enabled: true,
+			},
+			Ranking: RankingConfig{
+				TextWeight:  1.0,
+				DateWeight:  0.4,
+				MediaWeight: 0.2,
+				Media: map[string]float64{
+					"event": 1.0,
+					"audio": 0.8,
+					"video": 0.6,
+				},
+				Providers: map[string]float64{},
+			},
+			Breaker: BreakerConfig{
+				Failures: 5,
+				Cooldown: 60,
+			},
+			Saved: SavedConfig{
+				Interval:         3600,
+				MaxPerProfile:    20,
+				MaxNotifications: 100,
+			},
+			Analytics: AnalyticsConfig{
+				Retention:       30,
+				PromotionWindow: 86400,
+			},
+			Fixtures: FixturesConfig{
+				Path: "./fixtures",
 			},
 		},
 		Twitter: TwitterConfig{
@@ -118,6 +273,23 @@ var (
 		Geo: GeoConfig{
 			CityDb: "./data/GeoLiteCity.dat",
 		},
+		Redis: RedisConfig{
+			Address: "127.0.0.1:6379",
+			Prefix:  "ptserver:",
+		},
+		Mail: MailConfig{
+			Backend:      MailBackendFile,
+			From:         "Placetime <noreply@placetime.com>",
+			Path:         "./mail",
+			ResetExpiry:  3600,
+			VerifyExpiry: 86400 * 3,
+			ResetWindow:  3600,
+			ResetPidMax:  3,
+			ResetIPMax:   20,
+			SMTP: SMTPConfig{
+				Address: "127.0.0.1:25",
+			},
+		},
 	}
 )
 
@@ -164,9 +336,37 @@ func readConfig() {
 		config.Image.Path = imgDir
 	}
 
+	if fixturesMode != "" {
+		config.Search.Fixtures.Mode = fixturesMode
+	}
+
 }
 
 func checkEnvironment() {
+	for _, proxy := range config.Web.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			applog.Errorf("Trusted proxy %s is not an address or CIDR range", proxy)
+			os.Exit(1)
+		}
+	}
+
+	if backend := config.Mail.Backend; backend != MailBackendSMTP && backend != MailBackendFile {
+		applog.Errorf("Unknown mail backend %s, must be %s or %s", backend, MailBackendSMTP, MailBackendFile)
+		os.Exit(1)
+	}
+
+	if base := config.Mail.BaseURL; base != "" {
+		if u, err := url.Parse(base); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			applog.Errorf("Mail base URL %s must be an absolute http or https URL", base)
+			os.Exit(1)
+		}
+	}
+
+	if mode := config.Search.Fixtures.Mode; mode != "" && mode != FixturesRecord && mode != FixturesReplay {
+		applog.Errorf("Unknown search fixtures mode %s, must be %s or %s", mode, FixturesRecord, FixturesReplay)
+		os.Exit(1)
+	}
+
 	f, err := os.Open(config.Image.Path)
 	if err != nil {
 		applog.Errorf("Could not open image path %s: %s", config.Image.Path, err.Error())
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"cgl.tideland.biz/applog"
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"net/http"
+)
+
+// Requests that change state are protected from cross site request forgery
+// with a double submit token. Each browser is given a random token in a
+// cookie, which pages and scripts must send back with every such request as
+// either the X-CSRF-Token header or the csrftoken form field. Other sites can
+// cause the cookie to be sent but cannot read it to supply the matching value.
+
+const (
+	csrfCookieName = "ptcsrf"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFormField  = "csrftoken"
+)
+
+// csrfToken returns the request's CSRF token, issuing a new one if the
+// request does not have one
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	token := randomString(24)
+	cookie := http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   config.Web.Session.Duration,
+		HttpOnly: true,
+		Secure:   config.Web.Session.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+	return token
+}
+
+// csrfSafe reports whether requests made with method cannot change state
+func csrfSafe(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// CSRFProtect rejects any request that may change state unless it carries the
+// CSRF token held in the requester's cookie
+func CSRFProtect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Browsers cannot be made to send an Authorization header to
+		// another site, and requests carrying one are never authenticated
+		// by cookie, so requests using API tokens need no CSRF token
+		if _, found := bearerToken(r); found || csrfSafe(r.Method) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(csrfCookieName)
+		if err != nil || cookie.Value == "" {
+			applog.Infof("Rejected %s %s from %s: no CSRF cookie", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Forbidden: missing CSRF token, fetch one from /-jcsrf", http.StatusForbidden)
+			return
+		}
+
+		token := r.Header.Get(csrfHeaderName)
+		if token == "" {
+			token = r.FormValue(csrfFormField)
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+			applog.Infof("Rejected %s %s from %s: CSRF token mismatch", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Forbidden: invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// csrfTemplateFuncs returns template functions that give pages the request's
+// CSRF token as {{csrftoken}} and a hidden form field as {{csrffield}}
+func csrfTemplateFuncs(w http.ResponseWriter, r *http.Request) template.FuncMap {
+	token := csrfToken(w, r)
+	return template.FuncMap{
+		"csrftoken": func() string {
+			return token
+		},
+		"csrffield": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrfFormField + `" value="` + template.HTMLEscapeString(token) + `">`)
+		},
+	}
+}
+
+func jsonCSRFHandler(w http.ResponseWriter, r *http.Request) {
+	token := csrfToken(w, r)
+
+	json, err := json.MarshalIndent(map[string]string{"token": token, "header": csrfHeaderName, "field": csrfFormField}, "", "  ")
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
+}
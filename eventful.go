@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// The eventful client library only fetches the first page of results so
+// searches are made against the JSON API directly
+
+const eventfulSearchUrl = "http://api.eventful.com/json/events/search"
+
+type EventfulSearchParams struct {
+	Keywords   string
+	Date       string
+	Location   string
+	Within     int // kilometres
+	PageSize   int
+	PageNumber int
+}
+
+type EventfulSearchResponse struct {
+	TotalItems string          `json:"total_items"`
+	PageNumber string          `json:"page_number"`
+	PageCount  string          `json:"page_count"`
+	PageSize   string          `json:"page_size"`
+	Events     *EventfulEvents `json:"events"`
+}
+
+// Eventful returns a single event as an object rather than an array
+type EventfulEvents struct {
+	Event json.RawMessage `json:"event"`
+}
+
+type EventfulEvent struct {
+	ID           string         `json:"id"`
+	Title        string         `json:"title"`
+	URL          string         `json:"url"`
+	StartTime    string         `json:"start_time"`
+	StopTime     string         `json:"stop_time"`
+	VenueName    string         `json:"venue_name"`
+	VenueAddress string         `json:"venue_address"`
+	CityName     string         `json:"city_name"`
+	Image        *EventfulImage `json:"image"`
+}
+
+type EventfulImage struct {
+	Small  *EventfulImageSize `json:"small"`
+	Medium *EventfulImageSize `json:"medium"`
+}
+
+type EventfulImageSize struct {
+	URL    string `json:"url"`
+	Width  string `json:"width"`
+	Height string `json:"height"`
+}
+
+// List returns the events in the response
+func (r *EventfulSearchResponse) List() ([]EventfulEvent, error) {
+	if r.Events == nil || len(r.Events.Event) == 0 {
+		return nil, nil
+	}
+
+	var events []EventfulEvent
+	if err := json.Unmarshal(r.Events.Event, &events); err == nil {
+		return events, nil
+	}
+
+	var event EventfulEvent
+	if err := json.Unmarshal(r.Events.Event, &event); err != nil {
+		return nil, err
+	}
+	return []EventfulEvent{event}, nil
+}
+
+// More reports whether there are further pages of results
+func (r *EventfulSearchResponse) More() bool {
+	page, _ := strconv.Atoi(r.PageNumber)
+	count, _ := strconv.Atoi(r.PageCount)
+	return page < count
+}
+
+func eventfulSearchEvents(ctx context.Context, client *http.Client, appKey string, params EventfulSearchParams) (*EventfulSearchResponse, error) {
+	query := url.Values{}
+	query.Set("app_key", appKey)
+	query.Set("keywords", params.Keywords)
+	query.Set("date", params.Date)
+	query.Set("sort_order", "date")
+	if params.Location != "" {
+		query.Set("location", params.Location)
+		if params.Within > 0 {
+			query.Set("within", strconv.Itoa(params.Within))
+			query.Set("units", "km")
+		}
+	}
+	if params.PageSize > 0 {
+		query.Set("page_size", strconv.Itoa(params.PageSize))
+	}
+	if params.PageNumber > 0 {
+		query.Set("page_number", strconv.Itoa(params.PageNumber))
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s?%s", eventfulSearchUrl, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Eventful returned status %s", resp.Status)
+	}
+
+	results := &EventfulSearchResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"cgl.tideland.biz/applog"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Each search provider has a circuit breaker. After a run of consecutive
+// failures the breaker opens and the provider is skipped until a cool-down
+// period has passed. A single probe search is then allowed through: success
+// closes the breaker again, failure starts another cool-down.
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "halfopen"
+)
+
+var ErrProviderUnavailable = errors.New("search provider is unavailable")
+
+// Weight given to the latest search when averaging latency and error rate
+const healthSmoothing = 0.2
+
+// ProviderHealth records how well a search provider has been responding
+type ProviderHealth struct {
+	Name                string    `json:"name"`
+	State               string    `json:"state"`
+	Searches            int64     `json:"searches"`
+	Failures            int64     `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutivefailures"`
+	ErrorRate           float64   `json:"errorrate"` // recent proportion of failed searches
+	Latency             float64   `json:"latency"`   // recent average milliseconds per search
+	LastError           string    `json:"lasterror,omitempty"`
+	LastErrorTime       time.Time `json:"lasterrortime,omitempty"`
+	OpenUntil           time.Time `json:"openuntil,omitempty"`
+
+	probing bool
+}
+
+var (
+	providerHealthMutex sync.Mutex
+	providerHealth      = make(map[string]*ProviderHealth)
+)
+
+func healthOf(name string) *ProviderHealth {
+	h, exists := providerHealth[name]
+	if !exists {
+		h = &ProviderHealth{Name: name, State: BreakerClosed}
+		providerHealth[name] = h
+	}
+	return h
+}
+
+// allowSearch reports whether the named provider may be searched now
+func allowSearch(name string) bool {
+	providerHealthMutex.Lock()
+	defer providerHealthMutex.Unlock()
+
+	h := healthOf(name)
+	switch h.State {
+	case BreakerOpen:
+		if time.Now().Before(h.OpenUntil) {
+			return false
+		}
+		h.State = BreakerHalfOpen
+		h.probing = true
+		applog.Infof("Probing search provider %s", name)
+		return true
+	case BreakerHalfOpen:
+		// Only one probe at a time
+		if h.probing {
+			return false
+		}
+		h.probing = true
+		return true
+	}
+	return true
+}
+
+// recordSearch updates the health of the named provider with the outcome of
+// a search
+func recordSearch(name string, latency time.Duration, err error) {
+	providerHealthMutex.Lock()
+	defer providerHealthMutex.Unlock()
+
+	h := healthOf(name)
+	h.Searches++
+	h.probing = false
+
+	ms := float64(latency) / float64(time.Millisecond)
+	if h.Searches == 1 {
+		h.Latency = ms
+	} else {
+		h.Latency += healthSmoothing * (ms - h.Latency)
+	}
+
+	if err == nil {
+		h.ErrorRate -= healthSmoothing * h.ErrorRate
+		h.ConsecutiveFailures = 0
+		if h.State != BreakerClosed {
+			applog.Infof("Search provider %s has recovered", name)
+			h.State = BreakerClosed
+		}
+		return
+	}
+
+	h.Failures++
+	h.ConsecutiveFailures++
+	h.ErrorRate += healthSmoothing * (1 - h.ErrorRate)
+	h.LastError = err.Error()
+	h.LastErrorTime = time.Now()
+
+	if h.State == BreakerHalfOpen || h.ConsecutiveFailures >= config.Search.Breaker.Failures {
+		if h.State != BreakerOpen {
+			applog.Errorf("Search provider %s is unavailable after %d failures, last error: %s", name, h.ConsecutiveFailures, h.LastError)
+		}
+		h.State = BreakerOpen
+		h.OpenUntil = time.Now().Add(time.Duration(config.Search.Breaker.Cooldown) * time.Second)
+	}
+}
+
+// abandonSearch releases a probe without recording an outcome
+func abandonSearch(name string) {
+	providerHealthMutex.Lock()
+	defer providerHealthMutex.Unlock()
+
+	healthOf(name).probing = false
+}
+
+// ProvidersHealth returns the health of every provider that has been searched
+func ProvidersHealth() []ProviderHealth {
+	providerHealthMutex.Lock()
+	defer providerHealthMutex.Unlock()
+
+	list := make([]ProviderHealth, 0, len(providerHealth))
+	for _, h := range providerHealth {
+		list = append(list, *h)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// healthSearchProvider guards a provider with its circuit breaker and records
+// the outcome of each search
+type healthSearchProvider struct {
+	SearchProvider
+}
+
+// HealthSearchProvider wraps p so that its searches are tracked and skipped
+// while it is failing
+func HealthSearchProvider(p SearchProvider) SearchProvider {
+	return &healthSearchProvider{SearchProvider: p}
+}
+
+func (p *healthSearchProvider) Search(ctx context.Context, q SearchQuery) (*SearchPage, error) {
+	if !allowSearch(p.Name()) {
+		return nil, ErrProviderUnavailable
+	}
+
+	start := time.Now()
+	page, err := p.SearchProvider.Search(ctx, q)
+
+	// A provider that ignores cancellation has still failed to answer in time
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	// Searches abandoned by the caller say nothing about the provider
+	if errors.Is(err, context.Canceled) {
+		abandonSearch(p.Name())
+		return page, err
+	}
+
+	recordSearch(p.Name(), time.Since(start), err)
+	return page, err
+}
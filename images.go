@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"cgl.tideland.biz/applog"
+	"context"
+	"fmt"
+	"github.com/placetime/datastore"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Images chosen for items are mirrored into the image directory by a pool of
+// background workers. Each image is saved as <itemid>.png, no larger than the
+// biggest configured size, and as <itemid>-<width>.png for every size. Once
+// mirrored, the stored item is updated to use the local image. Audio items
+// found without an image are given the album image last.fm has for the track.
+
+type imageJob struct {
+	id       datastore.ItemIdType
+	url      string // empty to look up an image for the item's text instead
+	text     string
+	lifetime int // seconds the item is kept for, zero if it is permanent
+}
+
+var (
+	imageJobs        chan imageJob
+	imageJobsMutex   sync.Mutex
+	imageJobsPending = make(map[datastore.ItemIdType]bool)
+
+	// Items that have been looked up for a missing image, keyed by item id
+	imageLookups = NewCache(24*time.Hour, 0)
+)
+
+// Smallest image worth keeping, in pixels along each side
+const minImageSize = 16
+
+func startImagePipeline(c ImageConfig) {
+	imageJobs = make(chan imageJob, c.QueueLength)
+	for i := 0; i < c.Workers; i++ {
+		go imageWorker()
+	}
+}
+
+func imageWorker() {
+	for job := range imageJobs {
+		if err := mirrorImage(job); err != nil {
+			applog.Errorf("Could not mirror image %s for item %s: %s", job.url, job.id, err.Error())
+		} else if err := useMirroredImage(job); err != nil {
+			applog.Errorf("Could not update image of item %s: %s", job.id, err.Error())
+		}
+
+		imageJobsMutex.Lock()
+		delete(imageJobsPending, job.id)
+		imageJobsMutex.Unlock()
+	}
+}
+
+func mirroredImageFilename(id datastore.ItemIdType) string {
+	return fmt.Sprintf("%s.png", id)
+}
+
+func mirroredImageURL(id datastore.ItemIdType) string {
+	return fmt.Sprintf("/-img/%s", mirroredImageFilename(id))
+}
+
+// localImage returns the item with its image pointing at the local mirror
+// when one exists. Otherwise the image is queued for mirroring, or looked up
+// if an audio item has none, and the item is returned unchanged. Items may be
+// shared so they are never modified.
+func localImage(item *datastore.Item, lifetime int) *datastore.Item {
+	if strings.HasPrefix(item.Image, "/-img/") {
+		return item
+	}
+
+	if _, err := os.Stat(path.Join(config.Image.Path, mirroredImageFilename(item.Id))); err == nil {
+		local := *item
+		local.Image = mirroredImageURL(item.Id)
+		return &local
+	}
+
+	if item.Image != "" {
+		queueImage(imageJob{id: item.Id, url: item.Image, lifetime: lifetime})
+	} else if item.Media == "audio" {
+		if _, found, _ := imageLookups.Get(string(item.Id)); !found {
+			queueImage(imageJob{id: item.Id, text: item.Text, lifetime: lifetime})
+		}
+	}
+	return item
+}
+
+// queueImage schedules an image to be mirrored unless it is already queued
+// or the queue is full
+func queueImage(job imageJob) {
+	if imageJobs == nil {
+		return
+	}
+
+	imageJobsMutex.Lock()
+	defer imageJobsMutex.Unlock()
+
+	if imageJobsPending[job.id] {
+		return
+	}
+
+	select {
+	case imageJobs <- job:
+		imageJobsPending[job.id] = true
+	default:
+		applog.Debugf("Image queue full, not mirroring image for %s", job.id)
+	}
+}
+
+// lookupImage returns the URL of the album image last.fm has for an audio
+// item whose text is of the form "track / artist", or an empty string if
+// there is none
+func lookupImage(text string) (string, error) {
+	parts := strings.SplitN(text, " / ", 2)
+	if len(parts) != 2 || !config.Search.Lastfm.Enabled {
+		return "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Image.Timeout)*time.Millisecond)
+	defer cancel()
+
+	return fetchTrackImageLastfm(ctx, SearchClient(), parts[0], parts[1])
+}
+
+// mirrorImage downloads and verifies the job's image then writes it in each
+// of the configured sizes
+func mirrorImage(job imageJob) error {
+	if job.url == "" {
+		// Only looked up once whether or not an image is found
+		imageLookups.Set(string(job.id), true)
+
+		url, err := lookupImage(job.text)
+		if err != nil || url == "" {
+			return err
+		}
+		job.url = url
+	}
+
+	img, err := fetchImage(job.url)
+	if err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() < minImageSize || bounds.Dy() < minImageSize {
+		return fmt.Errorf("image is too small (%dx%d)", bounds.Dx(), bounds.Dy())
+	}
+
+	largest := 0
+	for _, width := range config.Image.Sizes {
+		if width > largest {
+			largest = width
+		}
+		if err := writeImage(fmt.Sprintf("%s-%d.png", job.id, width), resizeImage(img, width)); err != nil {
+			return err
+		}
+	}
+
+	// Written last so that its presence means every size is available
+	return writeImage(mirroredImageFilename(job.id), resizeImage(img, largest))
+}
+
+// useMirroredImage points the stored item at its mirrored image, keeping it
+// for the job's lifetime. Items that have not been stored yet are left for
+// localImage to update when they are next found.
+func useMirroredImage(job imageJob) error {
+	if _, err := os.Stat(path.Join(config.Image.Path, mirroredImageFilename(job.id))); err != nil {
+		return nil
+	}
+
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	item, err := s.Item(job.id)
+	if err != nil || item == nil {
+		return nil
+	}
+
+	if item.Image == mirroredImageURL(job.id) {
+		return nil
+	}
+
+	item.Image = mirroredImageURL(job.id)
+	return s.SaveItem(item, job.lifetime)
+}
+
+// fetchImage downloads and decodes an image, using the search client so that
+// images are fetched through the same transport as provider requests
+func fetchImage(url string) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Image.Timeout)*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := SearchClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned status %s", resp.Status)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" && !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("content type %s is not an image", contentType)
+	}
+
+	// Read one byte more than allowed to tell a large image from one that
+	// is exactly the limit
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, config.Image.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > config.Image.MaxBytes {
+		return nil, fmt.Errorf("image is larger than %d bytes", config.Image.MaxBytes)
+	}
+
+	// Check the dimensions before decoding so that a small file cannot
+	// claim a huge image
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if int64(imgConfig.Width)*int64(imgConfig.Height) > config.Image.MaxPixels {
+		return nil, fmt.Errorf("image has too many pixels (%dx%d)", imgConfig.Width, imgConfig.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// writeImage saves an image as png, via a temporary file so that readers
+// never see a partly written image
+func writeImage(filename string, img image.Image) error {
+	foutName := path.Join(config.Image.Path, filename)
+	tmpName := foutName + ".tmp"
+
+	fout, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+
+	if err := png.Encode(fout, img); err != nil {
+		fout.Close()
+		os.Remove(tmpName)
+		return err
+	}
+
+	if err := fout.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return os.Rename(tmpName, foutName)
+}
+
+// resizeImage scales an image down to the given width, preserving its aspect
+// ratio, by averaging the source pixels covered by each destination pixel.
+// Images that are already narrow enough are returned unchanged.
+func resizeImage(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	if width <= 0 || bounds.Dx() <= width {
+		return src
+	}
+
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy0 := bounds.Min.Y + y*bounds.Dy()/height
+		sy1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			sx0 := bounds.Min.X + x*bounds.Dx()/width
+			sx1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"cgl.tideland.biz/applog"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"strings"
+	"time"
+)
+
+// The item index maps each word in an item's text to the items containing
+// it. Each word has a sorted set of item ids scored by when the item was
+// indexed, so that the most recently added items are found first. Each item
+// has a set of the words it was indexed under so it can be reindexed or
+// removed, and items that expire from the datastore are tracked in a sorted
+// set scored by their expiry time.
+
+const (
+	ItemScopeOwn       = "own"
+	ItemScopeFollowing = "following"
+	ItemScopeAll       = "all"
+)
+
+// Maximum number of index matches examined for a single search
+const maxIndexCandidates = 500
+
+// Most items returned by a single stored item search
+const maxItemSearchCount = 100
+
+// Maximum number of followed profiles considered for a following search
+const maxIndexFollowing = 1000
+
+// Maximum number of items either side of now indexed from each timeline
+const maxIndexTimeline = 500
+
+// Time between indexing new items read from feeds
+const feedIndexInterval = 10 * time.Minute
+
+func indexTermKey(term string) string {
+	return redisKey("index", "term", term)
+}
+
+func indexItemKey(id datastore.ItemIdType) string {
+	return redisKey("index", "item", string(id))
+}
+
+func indexExpiryKey() string {
+	return redisKey("index", "expiry")
+}
+
+// indexTerms returns the distinct words of text worth indexing
+func indexTerms(text string) []string {
+	seen := make(map[string]bool)
+	terms := make([]string, 0)
+	for _, t := range searchTokens(text) {
+		if len(t) < 2 || seen[t] {
+			continue
+		}
+		seen[t] = true
+		terms = append(terms, t)
+	}
+	return terms
+}
+
+// addItem adds an item to the datastore, indexes its text and queues its
+// image for mirroring
+func addItem(s *datastore.RedisStore, pid datastore.PidType, ets time.Time, text string, link string, image string, media string, duration int) (datastore.ItemIdType, error) {
+	itemid, err := s.AddItem(pid, ets, text, link, image, "", media, duration)
+	if err != nil {
+		return itemid, err
+	}
+
+	if err := indexItem(&datastore.Item{Id: itemid, Pid: pid, Text: text}, 0); err != nil {
+		applog.Errorf("Could not index item %s: %s", itemid, err.Error())
+	}
+
+	if image != "" && !strings.HasPrefix(image, "/-img/") {
+		queueImage(imageJob{id: itemid, url: image})
+	}
+	return itemid, nil
+}
+
+// saveItem saves an item to the datastore for lifetime seconds. Only items
+// saved permanently are indexed, so results kept for a while after a provider
+// search are not found by stored item searches.
+func saveItem(s *datastore.RedisStore, item *datastore.Item, lifetime int) error {
+	if err := s.SaveItem(item, lifetime); err != nil {
+		return err
+	}
+
+	if lifetime > 0 {
+		return nil
+	}
+
+	if err := indexItem(item, 0); err != nil {
+		applog.Errorf("Could not index item %s: %s", item.Id, err.Error())
+	}
+	return nil
+}
+
+// indexItem records the words in the item's text, replacing any previous
+// entries for the item. A lifetime of zero indexes the item permanently.
+func indexItem(item *datastore.Item, lifetime int) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	oldTerms, err := redis.Strings(conn.Do("SMEMBERS", indexItemKey(item.Id)))
+	if err != nil {
+		return err
+	}
+
+	terms := indexTerms(item.Text)
+	current := make(map[string]bool, len(terms))
+	for _, t := range terms {
+		current[t] = true
+	}
+
+	now := time.Now().Unix()
+
+	conn.Send("MULTI")
+	for _, t := range oldTerms {
+		if !current[t] {
+			conn.Send("ZREM", indexTermKey(t), item.Id)
+		}
+	}
+	conn.Send("DEL", indexItemKey(item.Id))
+	for _, t := range terms {
+		conn.Send("ZADD", indexTermKey(t), now, item.Id)
+		conn.Send("SADD", indexItemKey(item.Id), t)
+	}
+	if lifetime > 0 {
+		conn.Send("ZADD", indexExpiryKey(), now+int64(lifetime), item.Id)
+	} else {
+		conn.Send("ZREM", indexExpiryKey(), item.Id)
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// unindexItem removes all index entries for an item
+func unindexItem(conn redis.Conn, id datastore.ItemIdType) error {
+	terms, err := redis.Strings(conn.Do("SMEMBERS", indexItemKey(id)))
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	for _, t := range terms {
+		conn.Send("ZREM", indexTermKey(t), id)
+	}
+	conn.Send("DEL", indexItemKey(id))
+	conn.Send("ZREM", indexExpiryKey(), id)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// pruneItemIndex removes items whose lifetime has passed from the index
+func pruneItemIndex(conn redis.Conn) error {
+	ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", indexExpiryKey(), "-inf", time.Now().Unix()))
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := unindexItem(conn, datastore.ItemIdType(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexTimeline indexes the items in the timeline of pid, which holds the
+// items the profile has added or, for a feed, the items read from the feed.
+// Items that are already indexed are skipped unless all is set. It returns
+// the number of items indexed.
+func indexTimeline(s *datastore.RedisStore, pid datastore.PidType, all bool) (int, error) {
+	fitems, err := s.TimelineRange(pid, "m", time.Now(), maxIndexTimeline, maxIndexTimeline)
+	if err != nil {
+		return 0, err
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	indexed := 0
+	for _, fitem := range fitems {
+		if !all {
+			exists, err := redis.Bool(conn.Do("EXISTS", indexItemKey(fitem.Id)))
+			if err != nil {
+				return indexed, err
+			}
+			if exists {
+				continue
+			}
+		}
+
+		item, err := s.Item(fitem.Id)
+		if err != nil || item == nil {
+			continue
+		}
+
+		if err := indexItem(item, 0); err != nil {
+			return indexed, err
+		}
+		indexed++
+	}
+	return indexed, nil
+}
+
+// reindexItems rebuilds the item index from the timelines of every profile
+// in the datastore
+func reindexItems(s *datastore.RedisStore) error {
+	if err := clearItemIndex(); err != nil {
+		return err
+	}
+
+	// Every profile contains the empty string
+	plist, err := s.FindProfilesBySubstring("")
+	if err != nil {
+		return err
+	}
+
+	total := 0
+	for _, p := range plist {
+		indexed, err := indexTimeline(s, p.Pid, true)
+		if err != nil {
+			applog.Errorf("Could not index items of %s: %s", p.Pid, err.Error())
+		}
+		total += indexed
+	}
+	applog.Infof("Indexed %d items from %d profiles", total, len(plist))
+	return nil
+}
+
+// indexFeedItems indexes items read from feeds since they were last indexed.
+// Feeds are read outside the server so their items are not indexed as they
+// are added.
+func indexFeedItems(s *datastore.RedisStore) error {
+	plist, err := s.FindProfilesBySubstring("")
+	if err != nil {
+		return err
+	}
+
+	for _, p := range plist {
+		if p.FeedType == "" {
+			continue
+		}
+
+		indexed, err := indexTimeline(s, p.Pid, false)
+		if err != nil {
+			applog.Errorf("Could not index items of feed %s: %s", p.Pid, err.Error())
+			continue
+		}
+		if indexed > 0 {
+			applog.Debugf("Indexed %d new items from feed %s", indexed, p.Pid)
+		}
+	}
+	return nil
+}
+
+// startFeedIndexer indexes new feed items every feedIndexInterval
+func startFeedIndexer() {
+	go func() {
+		for _ = range time.Tick(feedIndexInterval) {
+			s := datastore.NewRedisStore()
+			if err := indexFeedItems(s); err != nil {
+				applog.Errorf("Could not index feed items: %s", err.Error())
+			}
+			s.Close()
+		}
+	}()
+}
+
+// clearItemIndex removes the entire item index
+func clearItemIndex() error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("KEYS", redisKey("index", "*")))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if _, err := conn.Do("DEL", key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findIndexedItems returns the ids of the most recently indexed items whose
+// text contains every word of srch
+func findIndexedItems(srch string, limit int) ([]datastore.ItemIdType, error) {
+	terms := indexTerms(srch)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	if err := pruneItemIndex(conn); err != nil {
+		return nil, err
+	}
+
+	key := indexTermKey(terms[0])
+	if len(terms) > 1 {
+		suffix, err := RandomString(8)
+		if err != nil {
+			return nil, err
+		}
+		key = redisKey("index", "tmp", suffix)
+
+		args := redis.Args{}.Add(key, len(terms))
+		for _, t := range terms {
+			args = args.Add(indexTermKey(t))
+		}
+		args = args.Add("AGGREGATE", "MAX")
+
+		if _, err := conn.Do("ZINTERSTORE", args...); err != nil {
+			return nil, err
+		}
+		defer conn.Do("DEL", key)
+	}
+
+	members, err := redis.Strings(conn.Do("ZREVRANGE", key, 0, limit-1))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]datastore.ItemIdType, len(members))
+	for i, m := range members {
+		ids[i] = datastore.ItemIdType(m)
+	}
+	return ids, nil
+}
+
+// StoredItemSearch searches the text of items already held in the datastore.
+// The scope restricts the search to items added by pid, by the profiles pid
+// follows or, for ItemScopeAll, to any item. The query's other restrictions
+// are applied to each matching item.
+func StoredItemSearch(q SearchQuery, scope string, pid datastore.PidType, start int, count int) (SearchResults, error) {
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	var pids map[datastore.PidType]bool
+	switch scope {
+	case ItemScopeOwn:
+		pids = map[datastore.PidType]bool{pid: true}
+	case ItemScopeFollowing:
+		following, err := s.Following(pid, maxIndexFollowing, 0)
+		if err != nil {
+			return SearchResults{}, err
+		}
+		pids = make(map[datastore.PidType]bool, len(following))
+		for _, p := range following {
+			pids[p.Pid] = true
+		}
+	case ItemScopeAll:
+		// Profiles and items have no visibility setting and /-jtl serves
+		// any profile's timeline to any session, so every indexed item is
+		// already visible to the caller. Provider results kept only for a
+		// while are never indexed, see saveItem.
+	default:
+		return SearchResults{}, fmt.Errorf("Unknown item search scope %s", scope)
+	}
+
+	ids, err := findIndexedItems(q.PlainText(), maxIndexCandidates)
+	if err != nil {
+		return SearchResults{}, err
+	}
+
+	terms := indexTerms(q.PlainText())
+	fitems := make(FormattedItemSearchResults, 0)
+	matched := 0
+	more := false
+
+	for _, id := range ids {
+		item, err := s.Item(id)
+		if err != nil || item == nil {
+			continue
+		}
+
+		if pids != nil && !pids[item.Pid] {
+			continue
+		}
+
+		// The index may be stale if the item's text has changed
+		if !containsTerms(item.Text, terms) || !q.Matches(item) {
+			continue
+		}
+
+		matched++
+		if matched <= start {
+			continue
+		}
+		if len(fitems) == count {
+			more = true
+			break
+		}
+
+		fitem, err := s.FormatItem(item, 0, item.Pid)
+		if err != nil {
+			continue
+		}
+		fitems = append(fitems, fitem)
+	}
+
+	return SearchResults{Results: fitems, More: more}, nil
+}
+
+func containsTerms(text string, terms []string) bool {
+	present := make(map[string]bool)
+	for _, t := range searchTokens(text) {
+		present[t] = true
+	}
+	for _, t := range terms {
+		if !present[t] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Last.fm is searched using its JSON API directly so that the requests can be
+// made with the search providers' http client
+
+const lastfmApiUrl = "http://ws.audioscrobbler.com/2.0/"
+
+// Last.fm image sizes from smallest to largest
+var lastfmImageSizes = map[string]int{
+	"small":      1,
+	"medium":     2,
+	"large":      3,
+	"extralarge": 4,
+	"mega":       5,
+}
+
+type LastfmImage struct {
+	URL  string `json:"#text"`
+	Size string `json:"size"`
+}
+
+// LastfmImages lists the sizes of a single image
+type LastfmImages []LastfmImage
+
+// Largest returns the URL of the largest size of the image, if any
+func (images LastfmImages) Largest() string {
+	best := ""
+	bestSize := 0
+	for _, img := range images {
+		if size := lastfmImageSizes[img.Size]; img.URL != "" && size > bestSize {
+			best = img.URL
+			bestSize = size
+		}
+	}
+	return best
+}
+
+// Error code returned when the artist or track searched for is unknown
+const lastfmErrorInvalidParameters = 6
+
+type LastfmError struct {
+	Code    int
+	Message string
+}
+
+func (e *LastfmError) Error() string {
+	return fmt.Sprintf("Last.fm returned error %d: %s", e.Code, e.Message)
+}
+
+// lastfmStatus is included in every response to report errors
+type lastfmStatus struct {
+	Code    int    `json:"error"`
+	Message string `json:"message"`
+}
+
+func (s *lastfmStatus) apiError() error {
+	if s.Code == 0 {
+		return nil
+	}
+	return &LastfmError{Code: s.Code, Message: s.Message}
+}
+
+type lastfmResponse interface {
+	apiError() error
+}
+
+type LastfmTrackSearchResponse struct {
+	lastfmStatus
+	Results *LastfmTrackResults `json:"results"`
+}
+
+type LastfmTrackResults struct {
+	TotalResults string `json:"opensearch:totalResults"`
+	StartIndex   string `json:"opensearch:startIndex"`
+	ItemsPerPage string `json:"opensearch:itemsPerPage"`
+
+	// Last.fm returns a string when there are no matches and a single
+	// track as an object rather than an array
+	TrackMatches json.RawMessage `json:"trackmatches"`
+}
+
+type LastfmTrack struct {
+	Name   string       `json:"name"`
+	Artist string       `json:"artist"`
+	URL    string       `json:"url"`
+	Image  LastfmImages `json:"image"`
+}
+
+// List returns the tracks in the response
+func (r *LastfmTrackResults) List() ([]LastfmTrack, error) {
+	var matches struct {
+		Track json.RawMessage `json:"track"`
+	}
+	if err := json.Unmarshal(r.TrackMatches, &matches); err != nil || len(matches.Track) == 0 {
+		return nil, nil
+	}
+
+	var tracks []LastfmTrack
+	if err := json.Unmarshal(matches.Track, &tracks); err == nil {
+		return tracks, nil
+	}
+
+	var track LastfmTrack
+	if err := json.Unmarshal(matches.Track, &track); err != nil {
+		return nil, err
+	}
+	return []LastfmTrack{track}, nil
+}
+
+// More reports whether there are further pages of results
+func (r *LastfmTrackResults) More() bool {
+	total, _ := strconv.Atoi(r.TotalResults)
+	start, _ := strconv.Atoi(r.StartIndex)
+	perPage, _ := strconv.Atoi(r.ItemsPerPage)
+	return start+perPage < total
+}
+
+type LastfmTrackInfoResponse struct {
+	lastfmStatus
+	Track *LastfmTrackInfo `json:"track"`
+}
+
+type LastfmTrackInfo struct {
+	Name  string       `json:"name"`
+	URL   string       `json:"url"`
+	Album *LastfmAlbum `json:"album"`
+}
+
+type LastfmAlbum struct {
+	Title string       `json:"title"`
+	Image LastfmImages `json:"image"`
+}
+
+type LastfmEventsResponse struct {
+	lastfmStatus
+	Events *LastfmEvents `json:"events"`
+}
+
+// Last.fm returns a single event as an object rather than an array
+type LastfmEvents struct {
+	Event json.RawMessage   `json:"event"`
+	Attr  LastfmEventsAttrs `json:"@attr"`
+}
+
+type LastfmEventsAttrs struct {
+	Page       string `json:"page"`
+	TotalPages string `json:"totalPages"`
+}
+
+type LastfmEvent struct {
+	ID        string        `json:"id"`
+	Title     string        `json:"title"`
+	URL       string        `json:"url"`
+	StartDate string        `json:"startDate"`
+	EndDate   string        `json:"endDate"`
+	Cancelled string        `json:"cancelled"`
+	Venue     LastfmVenue   `json:"venue"`
+	Artists   LastfmArtists `json:"artists"`
+	Image     LastfmImages  `json:"image"`
+}
+
+type LastfmArtists struct {
+	Headliner string `json:"headliner"`
+}
+
+type LastfmVenue struct {
+	Name     string         `json:"name"`
+	URL      string         `json:"url"`
+	Location LastfmLocation `json:"location"`
+}
+
+type LastfmLocation struct {
+	City  string         `json:"city"`
+	Point LastfmGeoPoint `json:"geo:point"`
+}
+
+type LastfmGeoPoint struct {
+	Lat  string `json:"geo:lat"`
+	Long string `json:"geo:long"`
+}
+
+// Coordinates returns the latitude and longitude of the venue, which are zero
+// when unknown
+func (v *LastfmVenue) Coordinates() (float64, float64) {
+	lat, _ := strconv.ParseFloat(v.Location.Point.Lat, 64)
+	lng, _ := strconv.ParseFloat(v.Location.Point.Long, 64)
+	return lat, lng
+}
+
+// Start returns the time the event starts
+func (e *LastfmEvent) Start() (time.Time, error) {
+	return time.Parse("Mon, 02 Jan 2006 15:04:05", e.StartDate)
+}
+
+// End returns the time the event ends, if known
+func (e *LastfmEvent) End() (time.Time, error) {
+	return time.Parse("Mon, 02 Jan 2006 15:04:05", e.EndDate)
+}
+
+// List returns the events in the response
+func (r *LastfmEventsResponse) List() ([]LastfmEvent, error) {
+	if r.Events == nil || len(r.Events.Event) == 0 {
+		return nil, nil
+	}
+
+	var events []LastfmEvent
+	if err := json.Unmarshal(r.Events.Event, &events); err == nil {
+		return events, nil
+	}
+
+	var event LastfmEvent
+	if err := json.Unmarshal(r.Events.Event, &event); err != nil {
+		return nil, err
+	}
+	return []LastfmEvent{event}, nil
+}
+
+// More reports whether there are further pages of results
+func (r *LastfmEventsResponse) More() bool {
+	if r.Events == nil {
+		return false
+	}
+	page, _ := strconv.Atoi(r.Events.Attr.Page)
+	count, _ := strconv.Atoi(r.Events.Attr.TotalPages)
+	return page < count
+}
+
+func lastfmSearchTracks(ctx context.Context, client *http.Client, apiKey string, track string, page int, limit int) (*LastfmTrackSearchResponse, error) {
+	query := url.Values{}
+	query.Set("method", "track.search")
+	query.Set("track", track)
+	query.Set("page", strconv.Itoa(page))
+	query.Set("limit", strconv.Itoa(limit))
+
+	results := &LastfmTrackSearchResponse{}
+	if err := lastfmCall(ctx, client, apiKey, query, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func lastfmTrackInfo(ctx context.Context, client *http.Client, apiKey string, track string, artist string) (*LastfmTrackInfoResponse, error) {
+	query := url.Values{}
+	query.Set("method", "track.getInfo")
+	query.Set("track", track)
+	query.Set("artist", artist)
+	query.Set("autocorrect", "1")
+
+	results := &LastfmTrackInfoResponse{}
+	if err := lastfmCall(ctx, client, apiKey, query, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func lastfmArtistEvents(ctx context.Context, client *http.Client, apiKey string, artist string, page int, limit int) (*LastfmEventsResponse, error) {
+	query := url.Values{}
+	query.Set("method", "artist.getEvents")
+	query.Set("artist", artist)
+	query.Set("autocorrect", "1")
+	query.Set("page", strconv.Itoa(page))
+	query.Set("limit", strconv.Itoa(limit))
+
+	results := &LastfmEventsResponse{}
+	if err := lastfmCall(ctx, client, apiKey, query, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// lastfmCall makes an API request and decodes the response into results.
+// Last.fm reports most errors in the body of a successful response.
+func lastfmCall(ctx context.Context, client *http.Client, apiKey string, query url.Values, results lastfmResponse) error {
+	query.Set("api_key", apiKey)
+	query.Set("format", "json")
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s?%s", lastfmApiUrl, query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(results); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Last.fm returned status %s", resp.Status)
+		}
+		return err
+	}
+
+	if err := results.apiError(); err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Last.fm returned status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cgl.tideland.biz/applog"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"time"
+)
+
+// Failed logins are counted for each profile and for each client address
+// over a window of time. Once either count reaches its limit, further logins
+// for that profile or from that address are refused for a lockout period that
+// doubles with each further failure. Failures are counted for pids whether or
+// not the profile exists so the responses do not reveal which profiles do.
+
+// Most lockouts kept for admins to review
+const maxLockoutRecords = 1000
+
+type Lockout struct {
+	Pid      datastore.PidType `json:"pid,omitempty"`
+	IP       string            `json:"ip,omitempty"`
+	From     string            `json:"from"` // address of the failed login that caused the lockout
+	Failures int               `json:"failures"`
+	Duration int               `json:"duration"` // seconds
+	Ts       int64             `json:"ts"`
+}
+
+func loginFailuresKey(kind string, id string) string {
+	return redisKey("loginfail", kind, id)
+}
+
+func loginLockKey(kind string, id string) string {
+	return redisKey("loginlock", kind, id)
+}
+
+func lockoutsKey() string {
+	return redisKey("loginlockouts")
+}
+
+// loginLocked returns the number of seconds until logins for pid from ip are
+// allowed again, or zero if they are allowed now
+func loginLocked(pid datastore.PidType, ip string) (int, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	conn.Send("TTL", loginLockKey("pid", string(pid)))
+	conn.Send("TTL", loginLockKey("ip", ip))
+	conn.Flush()
+
+	wait := 0
+	for i := 0; i < 2; i++ {
+		ttl, err := redis.Int(conn.Receive())
+		if err != nil {
+			return 0, err
+		}
+		if ttl > wait {
+			wait = ttl
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed login for pid from ip, locking out
+// further attempts once the configured limits are passed
+func recordLoginFailure(pid datastore.PidType, ip string) error {
+	c := config.Web.Login
+
+	if err := countLoginFailure("pid", string(pid), c.PidFailures, &Lockout{Pid: pid, From: ip}); err != nil {
+		return err
+	}
+	return countLoginFailure("ip", ip, c.IPFailures, &Lockout{IP: ip, From: ip})
+}
+
+func countLoginFailure(kind string, id string, limit int, lockout *Lockout) error {
+	c := config.Web.Login
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("INCR", loginFailuresKey(kind, id))
+	conn.Send("EXPIRE", loginFailuresKey(kind, id), c.Window)
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+
+	failures, err := redis.Int(replies[0], nil)
+	if err != nil || failures < limit {
+		return err
+	}
+
+	duration := c.Lockout
+	for i := limit; i < failures && duration < c.MaxLockout; i++ {
+		duration *= 2
+	}
+	if duration > c.MaxLockout {
+		duration = c.MaxLockout
+	}
+
+	lockout.Failures = failures
+	lockout.Duration = duration
+	lockout.Ts = time.Now().Unix()
+
+	data, err := json.Marshal(lockout)
+	if err != nil {
+		return err
+	}
+
+	applog.Infof("Locked out logins by %s %s for %d seconds after %d failures, last from %s", kind, id, duration, failures, lockout.From)
+
+	conn.Send("MULTI")
+	conn.Send("SETEX", loginLockKey(kind, id), duration, lockout.Ts)
+	// Keep counting failures until the lockout has passed
+	conn.Send("EXPIRE", loginFailuresKey(kind, id), c.Window+duration)
+	conn.Send("LPUSH", lockoutsKey(), data)
+	conn.Send("LTRIM", lockoutsKey(), 0, maxLockoutRecords-1)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// clearLoginFailures forgets the failed logins for pid after a successful
+// login. Failures from the client's address are still counted.
+func clearLoginFailures(pid datastore.PidType) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", loginFailuresKey("pid", string(pid)))
+	return err
+}
+
+// Lockouts returns the most recent login lockouts, newest first
+func Lockouts(start int, count int) ([]*Lockout, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("LRANGE", lockoutsKey(), start, start+count-1))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Lockout, 0, len(values))
+	for _, v := range values {
+		lockout := &Lockout{}
+		if err := json.Unmarshal([]byte(v), lockout); err != nil {
+			continue
+		}
+		list = append(list, lockout)
+	}
+	return list, nil
+}
+
+func clearLoginRecords() error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	for _, pattern := range []string{redisKey("loginfail", "*"), redisKey("loginlock", "*"), lockoutsKey()} {
+		keys, err := redis.Strings(conn.Do("KEYS", pattern))
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if _, err := conn.Do("DEL", key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path"
+	"time"
+)
+
+// Mail sent to users goes through a Mailer chosen by the mail configuration.
+// The smtp backend delivers mail through an SMTP server. The file backend
+// writes each message to a file instead, so mail can be read during
+// development without a mail server.
+
+const (
+	MailBackendSMTP = "smtp"
+	MailBackendFile = "file"
+)
+
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+var mailer Mailer
+
+func initMailer(c MailConfig) {
+	switch c.Backend {
+	case MailBackendSMTP:
+		mailer = &SMTPMailer{Address: c.SMTP.Address, Username: c.SMTP.Username, Password: c.SMTP.Password, From: c.From}
+	default:
+		mailer = &FileMailer{Path: c.Path, From: c.From}
+	}
+}
+
+// formatMessage returns a plain text message ready to be sent
+func formatMessage(from string, to string, subject string, body string) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n%s\r\n", body)
+	return msg.Bytes()
+}
+
+type SMTPMailer struct {
+	Address  string // host:port of the SMTP server
+	Username string // no authentication is used when empty
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Address)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	return smtp.SendMail(m.Address, auth, m.From, []string{to}, formatMessage(m.From, to, subject, body))
+}
+
+// FileMailer writes each message to a file named after the time it was sent
+type FileMailer struct {
+	Path string
+	From string
+}
+
+func (m *FileMailer) Send(to string, subject string, body string) error {
+	if err := os.MkdirAll(m.Path, 0755); err != nil {
+		return err
+	}
+
+	filename := path.Join(m.Path, fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), randomString(6)))
+	return ioutil.WriteFile(filename, formatMessage(m.From, to, subject, body), 0600)
+}
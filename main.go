@@ -42,6 +42,7 @@ var (
 	newUserCookieName = "ptnewuser"
 	doinit            = false
 	doinitdata        = false
+	fixturesMode      = ""
 	cityDb            *libgeo.GeoIP
 )
 
@@ -57,7 +58,6 @@ type GeoLocation struct {
 }
 
 // TODO: Look into https://github.com/PuerkitoBio/ghost
-// TODO: https://github.com/craigmj/gototp
 
 func main() {
 	mr.Seed(time.Now().UTC().UnixNano())
@@ -68,6 +68,7 @@ func main() {
 	flag.StringVar(&imgDir, "images", "/var/opt/timescroll/img", "filesystem directory to store fetched images")
 	flag.BoolVar(&doinit, "init", false, "re-initialize database (warning: will wipe eveything)")
 	flag.BoolVar(&doinitdata, "initdata", false, "re-initialize database with data (warning: will wipe eveything)")
+	flag.StringVar(&fixturesMode, "fixtures", "", "record or replay search provider responses as fixture files")
 	flag.Parse()
 
 	// go func() {
@@ -84,6 +85,10 @@ func main() {
 		initData()
 	}
 
+	startImagePipeline(config.Image)
+	startSavedSearchScheduler()
+	startFeedIndexer()
+
 	r := mux.NewRouter()
 
 	r.PathPrefix("/policies").HandlerFunc(vocabRedirectHandler).Methods("GET", "HEAD")
@@ -106,19 +111,28 @@ func main() {
 	r.HandleFunc("/-jsp", jsonSuggestedProfilesHandler).Methods("GET", "HEAD")
 	r.HandleFunc("/-jpr", jsonProfileHandler).Methods("GET", "HEAD")
 	r.HandleFunc("/-jit", jsonItemHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/-jtl", jsonTimelineHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-jtl", withScope(ScopeReadTimeline, jsonTimelineHandler)).Methods("GET", "HEAD")
 	r.HandleFunc("/-jsp", jsonSuggestedProfilesHandler).Methods("GET", "HEAD")
 	r.HandleFunc("/-jfollowers", jsonFollowersHandler).Methods("GET", "HEAD")
-	r.HandleFunc("/-jfollowing", jsonFollowingHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-jfollowing", withScope(ScopeManageFollows, jsonFollowingHandler)).Methods("GET", "HEAD")
 	r.HandleFunc("/-jfeeds", jsonFeedsHandler).Methods("GET", "HEAD")
 	r.HandleFunc("/-jflaggedprofiles", jsonFlaggedProfilesHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-jlockouts", jsonLockoutsHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-jsearchhealth", jsonSearchHealthHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-jsearchtop", jsonSearchTopHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-jsearchzero", jsonSearchZeroHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-jsearchconversion", jsonSearchConversionHandler).Methods("GET", "HEAD")
 	r.HandleFunc("/-jsearch", jsonSearchHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-jprofilesuggest", jsonProfileSuggestHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-jsavedsearches", jsonSavedSearchesHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-jnotifications", jsonNotificationsHandler).Methods("GET", "HEAD")
 	r.HandleFunc("/-jgeo", jsonGeoHandler).Methods("GET", "HEAD")
 	r.HandleFunc("/-jdetect", jsonDetectHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-jcsrf", jsonCSRFHandler).Methods("GET", "HEAD")
 
-	r.HandleFunc("/-tfollow", followHandler).Methods("POST")
-	r.HandleFunc("/-tunfollow", unfollowHandler).Methods("POST")
-	r.HandleFunc("/-tadd", addHandler).Methods("POST")
+	r.HandleFunc("/-tfollow", withScope(ScopeManageFollows, followHandler)).Methods("POST")
+	r.HandleFunc("/-tunfollow", withScope(ScopeManageFollows, unfollowHandler)).Methods("POST")
+	r.HandleFunc("/-tadd", withScope(ScopeAddItems, addHandler)).Methods("POST")
 	r.HandleFunc("/-tpromote", promoteHandler).Methods("POST")
 	r.HandleFunc("/-tdemote", demoteHandler).Methods("POST")
 	r.HandleFunc("/-taddsuggest", addSuggestHandler).Methods("POST")
@@ -127,10 +141,34 @@ func main() {
 	r.HandleFunc("/-tupdateprofile", updateProfileHandler).Methods("POST")
 	r.HandleFunc("/-tremprofile", removeProfileHandler).Methods("POST")
 	r.HandleFunc("/-tflagprofile", flagProfileHandler).Methods("POST")
+	r.HandleFunc("/-tindexprofiles", indexProfilesHandler).Methods("POST")
+	r.HandleFunc("/-tindexitems", indexItemsHandler).Methods("POST")
+	r.HandleFunc("/-tsavesearch", saveSearchHandler).Methods("POST")
+	r.HandleFunc("/-tremsearch", remSearchHandler).Methods("POST")
+	r.HandleFunc("/-tclearnotifications", clearNotificationsHandler).Methods("POST")
 
 	r.HandleFunc("/-ping", pingHandler).Methods("GET")
 	r.HandleFunc("/-session", sessionHandler).Methods("POST")
 	r.HandleFunc("/-chksession", checkSessionHandler).Methods("GET")
+	r.HandleFunc("/-logout", logoutHandler).Methods("POST")
+	r.HandleFunc("/-jsessions", jsonSessionsHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-trevokesession", revokeSessionHandler).Methods("POST")
+	r.HandleFunc("/-trevokesessions", revokeSessionsHandler).Methods("POST")
+	r.HandleFunc("/-japitokens", jsonAPITokensHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-tcreateapitoken", createAPITokenHandler).Methods("POST")
+	r.HandleFunc("/-trevokeapitoken", revokeAPITokenHandler).Methods("POST")
+	r.HandleFunc("/-ttotpenroll", totpEnrollHandler).Methods("POST")
+	r.HandleFunc("/-ttotpconfirm", totpConfirmHandler).Methods("POST")
+	r.HandleFunc("/-ttotpdisable", totpDisableHandler).Methods("POST")
+	r.HandleFunc("/-ttotprecovery", totpRecoveryHandler).Methods("POST")
+	r.HandleFunc("/-totplogin", totpLoginPageHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-ttotplogin", totpLoginHandler).Methods("POST")
+	r.HandleFunc("/-tresetrequest", resetRequestHandler).Methods("POST")
+	r.HandleFunc("/-resetpassword", resetPasswordPageHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/-tresetpassword", resetPasswordHandler).Methods("POST")
+	r.HandleFunc("/-tsendverify", sendVerifyHandler).Methods("POST")
+	r.HandleFunc("/-verifyemail", verifyEmailHandler).Methods("GET")
+	r.HandleFunc("/-jemailstatus", jsonEmailStatusHandler).Methods("GET", "HEAD")
 	r.HandleFunc("/-twitter", twitterHandler).Methods("GET")
 	r.HandleFunc("/-soauth", soauthHandler).Methods("GET")
 	r.HandleFunc("/-tmpl", templatesHandler).Methods("GET")
@@ -140,7 +178,7 @@ func main() {
 
 	server := &http.Server{
 		Addr:        config.Web.Address,
-		Handler:     Log(r),
+		Handler:     Log(CSRFProtect(r)),
 		ReadTimeout: 30 * time.Second,
 	}
 
@@ -202,6 +240,10 @@ func Configure() {
 	checkEnvironment()
 
 	datastore.InitRedisStore(config.Datastore, config.Image.Path)
+	initRedisPool(config.Redis)
+	initSessionKeys(config.Web.Session)
+	initMailer(config.Mail)
+	initSearchProviders(config.Search, newSearchClient(config.Search.Fixtures))
 
 	var err error
 	cityDb, err = libgeo.Load(config.Geo.CityDb)
@@ -288,7 +330,7 @@ func imgHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func homepageHandler(w http.ResponseWriter, r *http.Request) {
-	templates := template.Must(template.ParseFiles(path.Join(config.Web.Path, "html/homepage.html")))
+	templates := template.Must(template.New("homepage.html").Funcs(csrfTemplateFuncs(w, r)).ParseFiles(path.Join(config.Web.Path, "html/homepage.html")))
 
 	err := templates.ExecuteTemplate(w, "homepage.html", nil)
 	if err != nil {
@@ -298,7 +340,7 @@ func homepageHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func timelineHandler(w http.ResponseWriter, r *http.Request) {
-	templates := template.Must(template.ParseFiles(path.Join(config.Web.Path, "html/timeline.html")))
+	templates := template.Must(template.New("timeline.html").Funcs(csrfTemplateFuncs(w, r)).ParseFiles(path.Join(config.Web.Path, "html/timeline.html")))
 
 	err := templates.ExecuteTemplate(w, "timeline.html", nil)
 	if err != nil {
@@ -308,7 +350,7 @@ func timelineHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func itemHandler(w http.ResponseWriter, r *http.Request) {
-	templates := template.Must(template.ParseFiles(path.Join(config.Web.Path, "html/item.html")))
+	templates := template.Must(template.New("item.html").Funcs(csrfTemplateFuncs(w, r)).ParseFiles(path.Join(config.Web.Path, "html/item.html")))
 
 	vars := mux.Vars(r)
 	id := datastore.ItemIdType(vars["id"])
@@ -554,8 +596,7 @@ func followHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	pid := datastore.PidType(r.FormValue("pid"))
-	if pid != sessionPid && !isAdmin(sessionPid) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if !authorize(w, r, sessionPid, pid) {
 		return
 	}
 
@@ -574,6 +615,11 @@ func followHandler(w http.ResponseWriter, r *http.Request) {
 		ErrorResponse(w, r, err)
 		return
 	}
+
+	followingCache.Delete(string(pid))
+	if err := indexProfile(s, followpid); err != nil {
+		applog.Errorf("Could not index profile %s: %s", followpid, err.Error())
+	}
 	fmt.Fprint(w, "ACK")
 }
 
@@ -584,8 +630,7 @@ func unfollowHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	pid := datastore.PidType(r.FormValue("pid"))
-	if pid != sessionPid {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if !authorize(w, r, sessionPid, pid) {
 		return
 	}
 
@@ -598,6 +643,11 @@ func unfollowHandler(w http.ResponseWriter, r *http.Request) {
 		ErrorResponse(w, r, err)
 		return
 	}
+
+	followingCache.Delete(string(pid))
+	if err := indexProfile(s, followpid); err != nil {
+		applog.Errorf("Could not index profile %s: %s", followpid, err.Error())
+	}
 	fmt.Fprint(w, "ACK")
 }
 
@@ -606,6 +656,27 @@ func clearData() {
 	defer s.Close()
 	applog.Infof("Resetting database")
 	s.ResetAll()
+	if err := clearItemIndex(); err != nil {
+		applog.Errorf("Could not clear item index: %s", err.Error())
+	}
+	if err := clearSavedSearches(); err != nil {
+		applog.Errorf("Could not clear saved searches: %s", err.Error())
+	}
+	if err := clearProfileIndex(); err != nil {
+		applog.Errorf("Could not clear profile index: %s", err.Error())
+	}
+	if err := clearAPITokens(); err != nil {
+		applog.Errorf("Could not clear API tokens: %s", err.Error())
+	}
+	if err := clearTOTP(); err != nil {
+		applog.Errorf("Could not clear two factor authentication: %s", err.Error())
+	}
+	if err := clearAccountTokens(); err != nil {
+		applog.Errorf("Could not clear account tokens: %s", err.Error())
+	}
+	if err := clearLoginRecords(); err != nil {
+		applog.Errorf("Could not clear failed logins: %s", err.Error())
+	}
 
 }
 
@@ -631,17 +702,17 @@ func initData() {
 	s.AddProfile("@nasa", "nasa", "Nasa Missions", "Upcoming NASA mission information.", "", "", "", "", "", "", "", "", "")
 
 	applog.Infof("Adding items for nasa")
-	s.AddItem("@nasa", parseKnownTime("1 Jan 2015"), "BepiColombo - Launch of ESA and ISAS Orbiter and Lander Missions to Mercury", "", "", "", "", 0)
-	s.AddItem("@nasa", parseKnownTime("26 Aug 2012"), "Dawn - Leaves asteroid Vesta, heads for asteroid 1 Ceres", "", "", "", "", 0)
-	s.AddItem("@nasa", parseKnownTime("1 Sep 2012"), "BepiColombo - Launch of ESA and ISAS Orbiter and Lander Missions to Mercury", "", "", "", "", 0)
-	s.AddItem("@nasa", parseKnownTime("1 Feb 2015"), "Dawn - Goes into orbit around asteroid 1 Ceres", "", "", "", "", 0)
-	s.AddItem("@nasa", parseKnownTime("14 Jul 2015"), "New Horizons - NASA mission reaches Pluto and Charon", "", "", "", "", 0)
-	s.AddItem("@nasa", parseKnownTime("1 Mar 2013"), "LADEE - Launch of NASA Orbiter to the Moon", "", "", "", "", 0)
-	s.AddItem("@nasa", parseKnownTime("1 Nov 2014"), "Philae - ESA Rosetta Lander touches down on Comet Churyumov-Gerasimenko", "", "", "", "", 0)
-	s.AddItem("@nasa", parseKnownTime("1 Nov 2013"), "MAVEN - Launch of Mars Orbiter", "", "", "", "", 0)
-	s.AddItem("@nasa", parseKnownTime("1 May 2014"), "Rosetta - ESA mission reaches Comet Churyumov-Gerasimenko", "", "", "", "", 0)
-	s.AddItem("@nasa", parseKnownTime("1 Jan 2014"), "Mars Sample Return Mission - Launch of NASA sample return mission to Mars", "", "", "", "", 0)
-	s.AddItem("@nasa", parseKnownTime("5 Apr 2231"), "Pluto - is passed by Neptune in distance from the Sun for the next 20 years", "", "", "", "", 0)
+	addItem(s, "@nasa", parseKnownTime("1 Jan 2015"), "BepiColombo - Launch of ESA and ISAS Orbiter and Lander Missions to Mercury", "", "", "", 0)
+	addItem(s, "@nasa", parseKnownTime("26 Aug 2012"), "Dawn - Leaves asteroid Vesta, heads for asteroid 1 Ceres", "", "", "", 0)
+	addItem(s, "@nasa", parseKnownTime("1 Sep 2012"), "BepiColombo - Launch of ESA and ISAS Orbiter and Lander Missions to Mercury", "", "", "", 0)
+	addItem(s, "@nasa", parseKnownTime("1 Feb 2015"), "Dawn - Goes into orbit around asteroid 1 Ceres", "", "", "", 0)
+	addItem(s, "@nasa", parseKnownTime("14 Jul 2015"), "New Horizons - NASA mission reaches Pluto and Charon", "", "", "", 0)
+	addItem(s, "@nasa", parseKnownTime("1 Mar 2013"), "LADEE - Launch of NASA Orbiter to the Moon", "", "", "", 0)
+	addItem(s, "@nasa", parseKnownTime("1 Nov 2014"), "Philae - ESA Rosetta Lander touches down on Comet Churyumov-Gerasimenko", "", "", "", 0)
+	addItem(s, "@nasa", parseKnownTime("1 Nov 2013"), "MAVEN - Launch of Mars Orbiter", "", "", "", 0)
+	addItem(s, "@nasa", parseKnownTime("1 May 2014"), "Rosetta - ESA mission reaches Comet Churyumov-Gerasimenko", "", "", "", 0)
+	addItem(s, "@nasa", parseKnownTime("1 Jan 2014"), "Mars Sample Return Mission - Launch of NASA sample return mission to Mars", "", "", "", 0)
+	addItem(s, "@nasa", parseKnownTime("5 Apr 2231"), "Pluto - is passed by Neptune in distance from the Sun for the next 20 years", "", "", "", 0)
 
 	applog.Infof("Adding profile for @visitlondon")
 	err = s.AddProfile("@visitlondon", "sunshine", "visitlondon.com", "", "", "", "", "", "", "", "", "", "")
@@ -689,6 +760,11 @@ func initData() {
 	s.Follow("@daveg", "@nasa")
 	s.Follow("@daveg", "@iand")
 
+	applog.Infof("Indexing profiles")
+	if err := reindexProfiles(s); err != nil {
+		applog.Errorf("Could not index profiles: %s", err.Error())
+	}
+
 	applog.Infof("Initialisation complete")
 
 }
@@ -708,7 +784,7 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	templates := template.Must(template.ParseFiles(path.Join(config.Web.Path, "html/admin.html")))
+	templates := template.Must(template.New("admin.html").Funcs(csrfTemplateFuncs(w, r)).ParseFiles(path.Join(config.Web.Path, "html/admin.html")))
 
 	err := templates.ExecuteTemplate(w, "admin.html", nil)
 	if err != nil {
@@ -719,12 +795,16 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func addHandler(w http.ResponseWriter, r *http.Request) {
-	sessionValid, _ := checkSession(w, r, false)
+	sessionValid, sessionPid := checkSession(w, r, false)
 	if !sessionValid {
 		return
 	}
 
 	pid := datastore.PidType(r.FormValue("pid"))
+	if !authorize(w, r, sessionPid, pid) {
+		return
+	}
+
 	text := r.FormValue("text")
 	link := r.FormValue("link")
 	ets := r.FormValue("ets")
@@ -752,23 +832,12 @@ func addHandler(w http.ResponseWriter, r *http.Request) {
 	s := datastore.NewRedisStore()
 	defer s.Close()
 
-	etsParsed := time.Unix(0, 0)
-
-	eventNum, err := strconv.ParseInt(event, 10, 64)
+	etsParsed, err := parseEventTime(event)
 	if err != nil {
-		etsParsed, err = time.Parse(time.RFC3339, event)
-		if err != nil {
-			etsParsed, err = time.Parse("2006-01-02", event)
-			if err != nil {
-				etsParsed = time.Unix(0, 0)
-			}
-		}
-
-	} else {
-		etsParsed = time.Unix(eventNum, 0)
+		etsParsed = time.Unix(0, 0)
 	}
 
-	itemid, err := s.AddItem(pid, etsParsed, text, link, image, "", media, int(duration))
+	itemid, err := addItem(s, pid, etsParsed, text, link, image, media, int(duration))
 	if err != nil {
 		ErrorResponse(w, r, err)
 		return
@@ -784,8 +853,7 @@ func promoteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	pid := datastore.PidType(r.FormValue("pid"))
-	if pid != sessionPid && !isAdmin(sessionPid) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if !authorize(w, r, sessionPid, pid) {
 		return
 	}
 
@@ -800,6 +868,8 @@ func promoteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recordPromotion(pid, id)
+
 	itemResponse(id, pid, w, r)
 
 }
@@ -811,8 +881,7 @@ func demoteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	pid := datastore.PidType(r.FormValue("pid"))
-	if pid != sessionPid && !isAdmin(sessionPid) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if !authorize(w, r, sessionPid, pid) {
 		return
 	}
 
@@ -876,54 +945,156 @@ func remSuggestHandler(w http.ResponseWriter, r *http.Request) {
 func sessionHandler(w http.ResponseWriter, r *http.Request) {
 	pid := datastore.PidType(strings.ToLower(r.FormValue("pid")))
 	pwd := r.FormValue("pwd")
+	ip := remoteIP(r)
+
+	wait, err := loginLocked(pid, ip)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(wait))
+		http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+		return
+	}
 
 	s := datastore.NewRedisStore()
 	defer s.Close()
 
 	validPassword, err := s.VerifyPassword(pid, pwd)
 	if err != nil || !validPassword {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		loginFailed(pid, w, r)
 		return
 	}
 
+	// A missing code is refused like a wrong one so that the response does
+	// not reveal that the password was right
+	if !checkLoginSecondFactor(pid, r.FormValue("totp"), w, r) {
+		return
+	}
+
+	if err := clearLoginFailures(pid); err != nil {
+		applog.Errorf("Could not clear failed logins of %s: %s", pid, err.Error())
+	}
+
 	createSession(pid, w, r)
 	fmt.Fprint(w, "")
 }
 
-func checkSession(w http.ResponseWriter, r *http.Request, silent bool) (bool, datastore.PidType) {
-	var pid datastore.PidType
-	valid := false
+func totpLoginPageHandler(w http.ResponseWriter, r *http.Request) {
+	templates := template.Must(template.New("totplogin.html").Funcs(csrfTemplateFuncs(w, r)).ParseFiles(path.Join(config.Web.Path, "html/totplogin.html")))
 
-	cookie, err := r.Cookie(config.Web.Session.Cookie)
-	if err == nil {
-		parts := strings.Split(cookie.Value, "|")
-		if len(parts) == 2 {
-			pid = datastore.PidType(parts[0])
-			sessionId, err := strconv.ParseInt(parts[1], 10, 64)
-			s := datastore.NewRedisStore()
-			defer s.Close()
+	err := templates.ExecuteTemplate(w, "totplogin.html", map[string]string{"Token": r.FormValue("token")})
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+}
 
-			if err == nil {
-				valid, err = s.ValidSession(pid, sessionId)
-				if err != nil {
-					ErrorResponse(w, r, err)
-					return false, datastore.PidType("")
-				}
+// totpLoginHandler completes a login held open by StartTOTPLogin
+func totpLoginHandler(w http.ResponseWriter, r *http.Request) {
+	pid, err := FinishTOTPLogin(r.FormValue("token"))
+	if err != nil {
+		if err == ErrInvalidAccountToken {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	wait, err := loginLocked(pid, remoteIP(r))
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(wait))
+		http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	if !checkLoginSecondFactor(pid, r.FormValue("totp"), w, r) {
+		return
+	}
 
-				if valid {
-					newSessionId, err := s.SessionId(pid)
-					if err != nil {
-						ErrorResponse(w, r, err)
-						return false, datastore.PidType("")
-					}
+	if err := clearLoginFailures(pid); err != nil {
+		applog.Errorf("Could not clear failed logins of %s: %s", pid, err.Error())
+	}
 
-					value := fmt.Sprintf("%s|%d", pid, newSessionId)
+	createSession(pid, w, r)
+	fmt.Fprint(w, "")
+}
 
-					cookie := http.Cookie{Name: config.Web.Session.Cookie, Value: value, Path: "/", MaxAge: config.Web.Session.Duration}
-					http.SetCookie(w, &cookie)
-				}
+// checkLoginSecondFactor reports whether a login of pid that has passed its
+// first factor may go ahead. Profiles with two factor authentication enabled
+// must give a valid code, otherwise the login is refused and counted as
+// failed.
+func checkLoginSecondFactor(pid datastore.PidType, code string, w http.ResponseWriter, r *http.Request) bool {
+	totpEnabled, err := TOTPEnabled(pid)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return false
+	}
+	if !totpEnabled {
+		return true
+	}
+
+	validCode, err := VerifySecondFactor(pid, code)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return false
+	}
+	if !validCode {
+		loginFailed(pid, w, r)
+		return false
+	}
+	return true
+}
+
+// loginFailed counts a failed login for pid and refuses the login
+func loginFailed(pid datastore.PidType, w http.ResponseWriter, r *http.Request) {
+	if err := recordLoginFailure(pid, remoteIP(r)); err != nil {
+		applog.Errorf("Could not record failed login of %s: %s", pid, err.Error())
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func checkSession(w http.ResponseWriter, r *http.Request, silent bool) (bool, datastore.PidType) {
+	if token, found := bearerToken(r); found {
+		return checkAPIToken(w, r, token, silent)
+	}
+
+	valid := false
 
+	pid, sessionId, sid, found := readSessionCookie(r)
+	if found {
+		s := datastore.NewRedisStore()
+		defer s.Close()
+
+		var err error
+		valid, err = s.ValidSession(pid, sessionId)
+		if err != nil {
+			ErrorResponse(w, r, err)
+			return false, datastore.PidType("")
+		}
+
+		if valid {
+			valid, err = touchSession(pid, sid, r)
+			if err != nil {
+				ErrorResponse(w, r, err)
+				return false, datastore.PidType("")
+			}
+		}
+
+		if valid {
+			newSessionId, err := s.SessionId(pid)
+			if err != nil {
+				ErrorResponse(w, r, err)
+				return false, datastore.PidType("")
 			}
+
+			setSessionCookie(w, fmt.Sprintf("%s|%d|%s", pid, newSessionId, sid))
 		}
 	}
 
@@ -944,492 +1115,1500 @@ func createSession(pid datastore.PidType, w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	value := fmt.Sprintf("%s|%d", pid, sessionId)
-
-	cookie := http.Cookie{Name: config.Web.Session.Cookie, Value: value, Path: "/", MaxAge: 86400}
-	http.SetCookie(w, &cookie)
-
-}
-
-func checkSessionHandler(w http.ResponseWriter, r *http.Request) {
-	sessionValid, _ := checkSession(w, r, false)
-	if !sessionValid {
-		return
-	}
-}
-
-func createOauthSession(w http.ResponseWriter, r *http.Request, userConfig *oauth1a.UserConfig) (string, error) {
-	s := datastore.NewRedisStore()
-	defer s.Close()
-
-	data, err := json.Marshal(userConfig)
+	sid, err := startSession(pid, r)
 	if err != nil {
-		return "", err
+		ErrorResponse(w, r, err)
+		return
 	}
 
-	temporaryKey, _ := RandomString(12)
+	setSessionCookie(w, fmt.Sprintf("%s|%d|%s", pid, sessionId, sid))
 
-	err = s.SetOauthSessionData(temporaryKey, string(data))
-	if err != nil {
-		ErrorResponse(w, r, err)
-		return "", err
-	}
-	cookie := http.Cookie{Name: "oatmp", Value: temporaryKey, Path: "/", MaxAge: 600}
-	http.SetCookie(w, &cookie)
-	return temporaryKey, nil
 }
 
-func readOauthSession(w http.ResponseWriter, r *http.Request) (*oauth1a.UserConfig, error) {
-	s := datastore.NewRedisStore()
-	defer s.Close()
-
-	cookie, err := r.Cookie("oatmp")
-	if err != nil {
-		applog.Errorf("Could not read oatmp cookie: %s", err.Error())
-		return nil, err
+// readSessionCookie returns the pid, datastore session id and session id
+// held in the session cookie. The boolean result is false if there is no
+// well formed cookie with a valid signature.
+func readSessionCookie(r *http.Request) (datastore.PidType, int64, string, bool) {
+	value, found := sessionCookieValue(r)
+	if !found {
+		return "", 0, "", false
 	}
 
-	key := cookie.Value
-
-	data, err := s.GetOauthSessionData(key)
-	if err != nil {
-		ErrorResponse(w, r, err)
-		return nil, err
+	parts := strings.Split(value, "|")
+	if len(parts) != 3 {
+		return "", 0, "", false
 	}
 
-	userConfig := &oauth1a.UserConfig{}
-
-	err = json.Unmarshal([]byte(data), userConfig)
-
+	sessionId, err := strconv.ParseInt(parts[1], 10, 64)
 	if err != nil {
-		applog.Errorf("Could not unmarshal oauth session data: %s", err.Error())
-		return nil, err
+		return "", 0, "", false
 	}
-	return userConfig, nil
-}
 
-func addProfileHandler(w http.ResponseWriter, r *http.Request) {
-	pid := datastore.PidType(r.FormValue("pid"))
-	pwd := r.FormValue("pwd")
-	name := r.FormValue("pname")
-	feedtype := r.FormValue("feedtype")
-	feedurl := r.FormValue("feedurl")
-	bio := r.FormValue("bio")
-	parentpid := datastore.PidType(r.FormValue("parentpid"))
-	email := r.FormValue("email")
-	itemType := r.FormValue("itemtype")
+	return datastore.PidType(parts[0]), sessionId, parts[2], true
+}
 
-	var err error
-	if pwd == "" {
-		pwd, err = RandomString(18)
-		if err != nil {
-			applog.Errorf("Could not generate password: %s", err.Error())
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if pid, _, sid, found := readSessionCookie(r); found {
+		if err := RevokeSession(pid, sid); err != nil && err != ErrSessionNotFound {
 			ErrorResponse(w, r, err)
 			return
 		}
 	}
 
-	if feedtype == "" && feedurl != "" {
-		feedtype = datastore.FeedTypeRss
+	clearSessionCookie(w)
+	fmt.Fprint(w, "ACK")
+}
+
+func jsonSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
 	}
 
-	s := datastore.NewRedisStore()
-	defer s.Close()
+	_, _, sid, _ := readSessionCookie(r)
 
-	err = s.AddProfile(pid, pwd, name, bio, feedtype, feedurl, parentpid, email, "", "", "", "", itemType)
+	list, err := Sessions(sessionPid, sid)
 	if err != nil {
 		ErrorResponse(w, r, err)
 		return
 	}
-	sessionValid, _ := checkSession(w, r, true)
-	if !sessionValid {
-		createSession(pid, w, r)
+
+	json, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
 	}
-	fmt.Fprint(w, "")
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
 }
 
-func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
-	sessionValid, _ := checkSession(w, r, false)
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
 	if !sessionValid {
 		return
 	}
 
-	r.ParseForm()
-
-	_, exists := r.Form["pid"]
-	if !exists {
-		ErrorResponse(w, r, errors.New("pid parameter is required"))
+	err := RevokeSession(sessionPid, r.FormValue("id"))
+	if err != nil {
+		if err == ErrSessionNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		ErrorResponse(w, r, err)
 		return
 	}
 
-	pid := datastore.PidType(r.FormValue("pid"))
-
-	values := make(map[string]string, 0)
+	fmt.Fprint(w, "ACK")
+}
 
-	for _, p := range datastore.ProfileProperties {
-		if _, exists := r.Form[p]; exists {
-			values[p] = r.FormValue(p)
-		}
+func revokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
 	}
-	s := datastore.NewRedisStore()
-	defer s.Close()
 
-	err := s.UpdateProfile(pid, values)
-	if err != nil {
+	if err := RevokeSessions(sessionPid); err != nil {
 		ErrorResponse(w, r, err)
 		return
 	}
-	fmt.Fprint(w, "")
+
+	clearSessionCookie(w)
+	fmt.Fprint(w, "ACK")
 }
 
-func removeProfileHandler(w http.ResponseWriter, r *http.Request) {
+func jsonAPITokensHandler(w http.ResponseWriter, r *http.Request) {
 	sessionValid, sessionPid := checkSession(w, r, false)
 	if !sessionValid {
 		return
 	}
 
-	pid := datastore.PidType(r.FormValue("pid"))
-	if pid != sessionPid && !isAdmin(sessionPid) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	list, err := APITokens(sessionPid)
+	if err != nil {
+		ErrorResponse(w, r, err)
 		return
 	}
 
-	s := datastore.NewRedisStore()
-	defer s.Close()
-
-	err := s.RemoveProfile(pid)
+	json, err := json.MarshalIndent(list, "", "  ")
 	if err != nil {
 		ErrorResponse(w, r, err)
 		return
 	}
-	fmt.Fprint(w, "")
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
 }
 
-func flagProfileHandler(w http.ResponseWriter, r *http.Request) {
-	sessionValid, _ := checkSession(w, r, false)
+func createAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
 	if !sessionValid {
 		return
 	}
-	pid := datastore.PidType(r.FormValue("pid"))
-	if pid == "" {
-		ErrorResponse(w, r, errors.New("Missing required parameter 'pid'"))
+
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "name parameter is required", http.StatusBadRequest)
 		return
+	}
 
+	scopes := make([]string, 0)
+	r.ParseForm()
+	for _, value := range r.Form["scope"] {
+		for _, scope := range strings.Split(value, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				scopes = append(scopes, scope)
+			}
+		}
 	}
-	s := datastore.NewRedisStore()
-	defer s.Close()
 
-	err := s.FlagProfile(pid)
+	token, err := CreateAPIToken(sessionPid, name, scopes)
 	if err != nil {
-		ErrorResponse(w, r, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	fmt.Fprint(w, "")
-}
 
-func twitterHandler(w http.ResponseWriter, r *http.Request) {
+	json, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
+}
+
+func revokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+
+	err := RevokeAPIToken(sessionPid, r.FormValue("id"))
+	if err != nil {
+		if err == ErrAPITokenNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	fmt.Fprint(w, "ACK")
+}
+
+func totpEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+
+	enrollment, err := EnrollTOTP(sessionPid)
+	if err != nil {
+		if err == ErrTOTPEnabled {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	json, err := json.MarshalIndent(enrollment, "", "  ")
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
+}
+
+func totpConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+
+	codes, err := ConfirmTOTP(sessionPid, strings.TrimSpace(r.FormValue("code")))
+	if err != nil {
+		switch err {
+		case ErrTOTPInvalid, ErrTOTPNotEnrolled:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case ErrTOTPEnabled:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			ErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	recoveryResponse(codes, w, r)
+}
+
+func totpDisableHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid || !checkSecondFactor(sessionPid, w, r) {
+		return
+	}
+
+	if err := DisableTOTP(sessionPid); err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	fmt.Fprint(w, "ACK")
+}
+
+func totpRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid || !checkSecondFactor(sessionPid, w, r) {
+		return
+	}
+
+	codes, err := NewRecoveryCodes(sessionPid)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	recoveryResponse(codes, w, r)
+}
+
+// checkSecondFactor reports whether the request's code parameter is a valid
+// second factor for pid, which must have two factor authentication enabled
+func checkSecondFactor(pid datastore.PidType, w http.ResponseWriter, r *http.Request) bool {
+	enabled, err := TOTPEnabled(pid)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return false
+	}
+	if !enabled {
+		http.Error(w, ErrTOTPNotEnrolled.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	valid, err := VerifySecondFactor(pid, r.FormValue("code"))
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return false
+	}
+	if !valid {
+		http.Error(w, ErrTOTPInvalid.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func recoveryResponse(codes []string, w http.ResponseWriter, r *http.Request) {
+	json, err := json.MarshalIndent(map[string][]string{"recoverycodes": codes}, "", "  ")
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
+}
+
+func resetRequestHandler(w http.ResponseWriter, r *http.Request) {
+	pid := datastore.PidType(strings.ToLower(r.FormValue("pid")))
+
+	allowed, err := allowResetRequest(pid, remoteIP(r))
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(config.Mail.ResetWindow))
+		http.Error(w, "Too many password reset requests, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	// The link is sent in the background so that neither the response
+	// nor the time taken to give it reveal which profiles have addresses
+	go func() {
+		if err := RequestPasswordReset(pid); err != nil {
+			applog.Errorf("Could not send password reset for %s: %s", pid, err.Error())
+		}
+	}()
+	fmt.Fprint(w, "ACK")
+}
+
+func resetPasswordPageHandler(w http.ResponseWriter, r *http.Request) {
+	templates := template.Must(template.New("resetpassword.html").Funcs(csrfTemplateFuncs(w, r)).ParseFiles(path.Join(config.Web.Path, "html/resetpassword.html")))
+
+	err := templates.ExecuteTemplate(w, "resetpassword.html", map[string]string{"Token": r.FormValue("token")})
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	pwd := r.FormValue("pwd")
+	if pwd == "" {
+		http.Error(w, "pwd parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	_, err := ResetPassword(r.FormValue("token"), pwd)
+	if err != nil {
+		if err == ErrInvalidAccountToken {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	clearSessionCookie(w)
+	fmt.Fprint(w, "ACK")
+}
+
+func sendVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+
+	if err := SendEmailVerification(sessionPid); err != nil {
+		if err == ErrNoEmail {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	fmt.Fprint(w, "ACK")
+}
+
+func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := VerifyEmail(r.FormValue("token"))
+	if err != nil {
+		if err == ErrInvalidAccountToken {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/timeline", http.StatusSeeOther)
+}
+
+func jsonEmailStatusHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	profile, err := s.Profile(sessionPid)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	verified, err := EmailVerified(sessionPid, profile.Email)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	status := struct {
+		Email    string `json:"email"`
+		Verified bool   `json:"verified"`
+	}{profile.Email, verified}
+
+	json, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
+}
+
+func checkSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, _ := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+}
+
+func createOauthSession(w http.ResponseWriter, r *http.Request, userConfig *oauth1a.UserConfig) (string, error) {
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	data, err := json.Marshal(userConfig)
+	if err != nil {
+		return "", err
+	}
+
+	temporaryKey, _ := RandomString(12)
+
+	err = s.SetOauthSessionData(temporaryKey, string(data))
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return "", err
+	}
+	cookie := http.Cookie{Name: "oatmp", Value: temporaryKey, Path: "/", MaxAge: 600}
+	http.SetCookie(w, &cookie)
+	return temporaryKey, nil
+}
+
+func readOauthSession(w http.ResponseWriter, r *http.Request) (*oauth1a.UserConfig, error) {
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	cookie, err := r.Cookie("oatmp")
+	if err != nil {
+		applog.Errorf("Could not read oatmp cookie: %s", err.Error())
+		return nil, err
+	}
+
+	key := cookie.Value
+
+	data, err := s.GetOauthSessionData(key)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return nil, err
+	}
+
+	userConfig := &oauth1a.UserConfig{}
+
+	err = json.Unmarshal([]byte(data), userConfig)
+
+	if err != nil {
+		applog.Errorf("Could not unmarshal oauth session data: %s", err.Error())
+		return nil, err
+	}
+	return userConfig, nil
+}
+
+func addProfileHandler(w http.ResponseWriter, r *http.Request) {
+	pid := datastore.PidType(r.FormValue("pid"))
+	pwd := r.FormValue("pwd")
+	name := r.FormValue("pname")
+	feedtype := r.FormValue("feedtype")
+	feedurl := r.FormValue("feedurl")
+	bio := r.FormValue("bio")
+	parentpid := datastore.PidType(r.FormValue("parentpid"))
+	email := r.FormValue("email")
+	itemType := r.FormValue("itemtype")
+
+	var err error
+	if pwd == "" {
+		pwd, err = RandomString(18)
+		if err != nil {
+			applog.Errorf("Could not generate password: %s", err.Error())
+			ErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if feedtype == "" && feedurl != "" {
+		feedtype = datastore.FeedTypeRss
+	}
+
+	// A profile can only be created under a parent the session may act on
+	if parentpid != "" {
+		sessionValid, sessionPid := checkSession(w, r, false)
+		if !sessionValid || !authorize(w, r, sessionPid, parentpid) {
+			return
+		}
+	}
+
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	err = s.AddProfile(pid, pwd, name, bio, feedtype, feedurl, parentpid, email, "", "", "", "", itemType)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	if err := indexProfile(s, pid); err != nil {
+		applog.Errorf("Could not index profile %s: %s", pid, err.Error())
+	}
+	sessionValid, _ := checkSession(w, r, true)
+	if !sessionValid {
+		createSession(pid, w, r)
+	}
+	fmt.Fprint(w, "")
+}
+
+func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+
+	r.ParseForm()
+
+	_, exists := r.Form["pid"]
+	if !exists {
+		ErrorResponse(w, r, errors.New("pid parameter is required"))
+		return
+	}
+
+	pid := datastore.PidType(r.FormValue("pid"))
+	if !authorize(w, r, sessionPid, pid) {
+		return
+	}
+
+	values := make(map[string]string, 0)
+
+	for _, p := range datastore.ProfileProperties {
+		if _, exists := r.Form[p]; exists {
+			values[p] = r.FormValue(p)
+		}
+	}
+
+	// A profile can only be placed under a parent the session may act on
+	if parentpid, exists := values["parentpid"]; exists && parentpid != "" {
+		if !authorize(w, r, sessionPid, datastore.PidType(parentpid)) {
+			return
+		}
+	}
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	err := s.UpdateProfile(pid, values)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	if err := indexProfile(s, pid); err != nil {
+		applog.Errorf("Could not index profile %s: %s", pid, err.Error())
+	}
+	fmt.Fprint(w, "")
+}
+
+func removeProfileHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+
+	pid := datastore.PidType(r.FormValue("pid"))
+	if !authorize(w, r, sessionPid, pid) {
+		return
+	}
+
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	err := s.RemoveProfile(pid)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	if err := RevokeSessions(pid); err != nil {
+		applog.Errorf("Could not revoke sessions of %s: %s", pid, err.Error())
+	}
+	if err := RevokeAPITokens(pid); err != nil {
+		applog.Errorf("Could not revoke API tokens of %s: %s", pid, err.Error())
+	}
+	if err := DisableTOTP(pid); err != nil {
+		applog.Errorf("Could not remove two factor authentication of %s: %s", pid, err.Error())
+	}
+	if err := forgetVerifiedEmail(pid); err != nil {
+		applog.Errorf("Could not remove verified email of %s: %s", pid, err.Error())
+	}
+
+	if err := unindexProfile(pid); err != nil {
+		applog.Errorf("Could not remove profile %s from index: %s", pid, err.Error())
+	}
+	fmt.Fprint(w, "")
+}
+
+func flagProfileHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, _ := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+	pid := datastore.PidType(r.FormValue("pid"))
+	if pid == "" {
+		ErrorResponse(w, r, errors.New("Missing required parameter 'pid'"))
+		return
+
+	}
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	err := s.FlagProfile(pid)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	fmt.Fprint(w, "")
+}
+
+func twitterHandler(w http.ResponseWriter, r *http.Request) {
+	service := OauthService()
+
+	httpClient := new(http.Client)
+	userConfig := &oauth1a.UserConfig{}
+	err := userConfig.GetRequestToken(service, httpClient)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	url, err := userConfig.GetAuthorizeURL(service)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	createOauthSession(w, r, userConfig)
+	applog.Infof("Redirecting user to %s", url)
+
+	http.Redirect(w, r, url, http.StatusFound)
+
+}
+func soauthHandler(w http.ResponseWriter, r *http.Request) {
 	service := OauthService()
 
-	httpClient := new(http.Client)
-	userConfig := &oauth1a.UserConfig{}
-	err := userConfig.GetRequestToken(service, httpClient)
+	userConfig, err := readOauthSession(w, r)
+	if err != nil {
+		applog.Errorf("Could not read oauth session: %v", err)
+		ErrorResponse(w, r, errors.New("Could not parse authorization"))
+		return
+	}
+
+	token, verifier, err := userConfig.ParseAuthorize(r, service)
+	if err != nil {
+		applog.Errorf("Could not parse authorization: %v", err)
+		ErrorResponse(w, r, errors.New("Could not parse authorization"))
+		return
+	}
+	httpClient := new(http.Client)
+	err = userConfig.GetAccessToken(token, verifier, service, httpClient)
+	if err != nil {
+		applog.Errorf("Error getting access token: %v", err)
+		ErrorResponse(w, r, errors.New("Problem getting an access token"))
+		return
+	}
+
+	screenName := userConfig.AccessValues.Get("screen_name")
+
+	client := twittergo.NewClient(service.ClientConfig, userConfig)
+
+	query := url.Values{}
+	query.Set("screen_name", screenName)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("https://api.twitter.com/1.1/users/show.json?%s", query.Encode()), nil)
+	response, err := client.SendRequest(req)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		applog.Errorf("Received an error while reading twitter response: %s", err)
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	twitterUserData := &TwitterUser{}
+	err = json.Unmarshal(contents, twitterUserData)
+
+	if err != nil {
+		ErrorResponse(w, r, err)
+	}
+
+	pid := datastore.PidType(fmt.Sprintf("@%s", screenName))
+
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	exists, err := s.ProfileExists(pid)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	if !exists {
+		pwd, err := RandomString(18)
+		if err != nil {
+			applog.Errorf("Could not generate password: %s", err.Error())
+			ErrorResponse(w, r, err)
+			return
+		}
+
+		err = s.AddProfile(pid, pwd, twitterUserData.Name, twitterUserData.Description, "", "", "", "", twitterUserData.Location, twitterUserData.Url, twitterUserData.ProfileImageUrl, twitterUserData.ProfileImageUrlHttps, "")
+		if err != nil {
+			ErrorResponse(w, r, err)
+			return
+		}
+
+		cookie := http.Cookie{Name: newUserCookieName, Value: "true", Path: "/", MaxAge: config.Web.Session.Duration}
+		http.SetCookie(w, &cookie)
+
+	} else {
+		values := make(map[string]string, 0)
+		values["name"] = twitterUserData.Name
+		values["bio"] = twitterUserData.Description
+		values["url"] = twitterUserData.Url
+		values["location"] = twitterUserData.Location
+		values["profileimageurl"] = twitterUserData.ProfileImageUrl
+		values["profileimageurlhttps"] = twitterUserData.ProfileImageUrlHttps
+
+		s.UpdateProfile(pid, values)
+	}
+
+	if err := indexProfile(s, pid); err != nil {
+		applog.Errorf("Could not index profile %s: %s", pid, err.Error())
+	}
+
+	// Twitter only stands in for the password, so profiles with two factor
+	// authentication still have to give a code before getting a session
+	totpEnabled, err := TOTPEnabled(pid)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	if totpEnabled {
+		token, err := StartTOTPLogin(pid)
+		if err != nil {
+			ErrorResponse(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/-totplogin?token="+url.QueryEscape(token), http.StatusFound)
+		return
+	}
+
+	createSession(pid, w, r)
+	http.Redirect(w, r, "/timeline", http.StatusFound)
+
+}
+
+type TemplateMap map[string]string
+
+func packageTemplates() (*TemplateMap, error) {
+	filenames, err := filepath.Glob(fmt.Sprintf("%s/*.html", templatesDir))
+
+	if err != nil {
+		return nil, err
+	}
+
+	templateMap := make(TemplateMap, 0)
+
+	for _, filename := range filenames {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		templateMap[filename[len(templatesDir)-1:len(filename)-5]] = string(b)
+	}
+
+	return &templateMap, nil
+}
+
+func templatesHandler(w http.ResponseWriter, r *http.Request) {
+	tm, err := packageTemplates()
+
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	json, err := json.MarshalIndent(tm, "", "  ")
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/javascript")
+
+	w.Write([]byte(fmt.Sprintf("window.templates=%s;", json)))
+
+}
+
+func jsonFeedsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, _ := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+
+	pid := datastore.PidType(r.FormValue("pid"))
+
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	flist, err := s.Feeds(pid)
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	json, err := json.MarshalIndent(flist, "", "  ")
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
+
+}
+
+func jsonSearchHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, pid := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+
+	var result SearchResults
+	var resultIds []datastore.ItemIdType
+
+	started := time.Now()
+	srch := r.FormValue("s")
+	stype := r.FormValue("t")
+
+	if stype == "p" {
+		filter := ProfileFilter{
+			FeedType:  r.FormValue("feedtype"),
+			ItemType:  r.FormValue("itemtype"),
+			Location:  r.FormValue("location"),
+			ParentPid: datastore.PidType(r.FormValue("parentpid")),
+		}
+
+		// Every profile matching a filter may be listed without a search
+		if srch == "" && filter.IsEmpty() {
+			ErrorResponse(w, r, errors.New("Invalid search entered"))
+			return
+		}
+
+		start, err := strconv.ParseInt(r.FormValue("start"), 10, 0)
+		if err != nil || start < 0 {
+			start = 0
+		}
+
+		count, err := strconv.ParseInt(r.FormValue("count"), 10, 0)
+		if err != nil || count <= 0 {
+			count = 10
+		} else if count > maxProfileSearchCount {
+			count = maxProfileSearchCount
+		}
+
+		result, err = ProfileSearch(srch, filter, int(start), int(count))
+		if err != nil {
+			ErrorResponse(w, r, err)
+			return
+		}
+	} else if srch == "" {
+		ErrorResponse(w, r, errors.New("Invalid search entered"))
+		return
+	} else if stype == "i" {
+		// Stored items have no location, so only the text and dates of the
+		// search are used
+		q, err := searchQueryParams(r, srch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		scope := r.FormValue("scope")
+		switch scope {
+		case "":
+			scope = ItemScopeFollowing
+		case ItemScopeOwn, ItemScopeFollowing, ItemScopeAll:
+		default:
+			http.Error(w, "scope parameter must be own, following or all", http.StatusBadRequest)
+			return
+		}
+
+		start, err := strconv.ParseInt(r.FormValue("start"), 10, 0)
+		if err != nil || start < 0 {
+			start = 0
+		}
+
+		count, err := strconv.ParseInt(r.FormValue("count"), 10, 0)
+		if err != nil || count <= 0 {
+			count = 10
+		} else if count > maxItemSearchCount {
+			count = maxItemSearchCount
+		}
+
+		result, err = StoredItemSearch(q, scope, pid, int(start), int(count))
+		if err != nil {
+			ErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		q, err := searchQueryParams(r, srch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := searchLocationParams(r, &q, searchMediaTypes[stype]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		media := searchMediaTypes[stype]
+		if q.Media != "" {
+			media = q.Media
+		}
+
+		var cursor SearchCursor
+		if cursorParam := r.FormValue("cursor"); cursorParam != "" {
+			cursor, err = DecodeSearchCursor(cursorParam, SearchProviders(media))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else if page, err := strconv.ParseInt(r.FormValue("page"), 10, 0); err == nil && page > 1 {
+			cursor = PageSearchCursor(int(page), SearchProviders(media))
+		}
+
+		result = MediaSearch(r.Context(), q, media, pid, cursor)
+		if items, ok := result.Results.(ItemSearchResults); ok {
+			s := datastore.NewRedisStore()
+			defer s.Close()
+
+			fitems := make(FormattedItemSearchResults, 0)
+
+			for _, item := range items {
+				item = localImage(item, config.Search.Lifetime)
+				saveItem(s, item, config.Search.Lifetime)
+				resultIds = append(resultIds, item.Id)
+
+				fitem, err := s.FormatItem(item, 0, item.Pid)
+				if err != nil {
+					continue
+				}
+				fitems = append(fitems, fitem)
+			}
+
+			result.Results = fitems
+		}
+
+	}
+
+	recordSearchQuery(srch, stype, pid, result, time.Since(started), resultIds)
+
+	json, err := json.MarshalIndent(result, "", "  ")
 	if err != nil {
 		ErrorResponse(w, r, err)
 		return
 	}
-	url, err := userConfig.GetAuthorizeURL(service)
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
+
+}
+
+// searchQueryParams parses a search and applies the radius and date
+// restrictions given as parameters, which take precedence over those in the
+// search itself.
+func searchQueryParams(r *http.Request, srch string) (SearchQuery, error) {
+	q := ParseSearchQuery(srch)
+	q.Radius = config.Search.Radius
+
+	if q.PlainText() == "" {
+		return q, errors.New("Invalid search entered")
+	}
+
+	if radiusParam := r.FormValue("radius"); radiusParam != "" {
+		radius, err := strconv.ParseInt(radiusParam, 10, 0)
+		if err != nil || radius < 0 {
+			return q, errors.New("radius parameter must be a number of kilometres")
+		}
+		q.Radius = int(radius)
+	}
+
+	if fromParam := r.FormValue("from"); fromParam != "" {
+		from, err := parseEventTime(fromParam)
+		if err != nil {
+			return q, errors.New("from parameter is not a valid time")
+		}
+		q.From = from
+	}
+
+	if toParam := r.FormValue("to"); toParam != "" {
+		to, err := parseEndTime(toParam)
+		if err != nil {
+			return q, errors.New("to parameter is not a valid time")
+		}
+		q.To = to
+	}
+
+	return q, nil
+}
+
+// searchLocationParams applies the location given as a parameter, which
+// takes precedence over one in the search itself, and looks up its
+// coordinates. Without any location, searches that can find events are made
+// near the caller.
+func searchLocationParams(r *http.Request, q *SearchQuery, media string) error {
+	if q.Media != "" {
+		media = q.Media
+	}
+
+	if loc := r.FormValue("loc"); loc != "" {
+		q.Location = &SearchLocation{Name: loc}
+		if parts := strings.Split(loc, ","); len(parts) == 2 {
+			lat, laterr := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+			lng, lngerr := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			if laterr == nil && lngerr == nil {
+				q.Location = &SearchLocation{Latitude: lat, Longitude: lng}
+			}
+		}
+	} else if q.Location == nil && (media == "" || media == "event") {
+		if geo, found := geoLocate(clientIP(r)); found {
+			q.Location = &SearchLocation{Name: geo.City, Latitude: float64(geo.Latitude), Longitude: float64(geo.Longitude)}
+		}
+	}
+
+	return ResolveLocation(r.Context(), SearchClient(), q.Location)
+}
+
+// canActOn reports whether a session for sessionPid may act on pid. Sessions
+// may act on their own profile and on any feed or other profile whose parent
+// is their profile. Admins may act on any profile.
+func canActOn(sessionPid datastore.PidType, pid datastore.PidType) (bool, error) {
+	if sessionPid == "" {
+		return false, nil
+	}
+	if pid == sessionPid || isAdmin(sessionPid) {
+		return true, nil
+	}
+
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	profile, err := s.Profile(pid)
+	if err != nil {
+		return false, err
+	}
+	return profile != nil && profile.ParentPid == sessionPid, nil
+}
+
+// authorize reports whether a session for sessionPid may act on pid,
+// responding with Unauthorized if not or with an error if the check failed
+func authorize(w http.ResponseWriter, r *http.Request, sessionPid datastore.PidType, pid datastore.PidType) bool {
+	allowed, err := canActOn(sessionPid, pid)
 	if err != nil {
 		ErrorResponse(w, r, err)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func isAdmin(pid datastore.PidType) bool {
+	for _, v := range config.Web.Admins {
+		if datastore.PidType(v) == pid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseEventTime accepts a time as unix seconds, RFC3339 or a plain date
+func parseEventTime(event string) (time.Time, error) {
+	eventNum, err := strconv.ParseInt(event, 10, 64)
+	if err == nil {
+		return time.Unix(eventNum, 0), nil
+	}
+
+	etsParsed, err := time.Parse(time.RFC3339, event)
+	if err == nil {
+		return etsParsed, nil
+	}
+
+	return time.Parse("2006-01-02", event)
+}
+
+// parseEndTime accepts the same times as parseEventTime but treats a plain
+// date as the end of that day, so that a range ending on it includes the day
+func parseEndTime(value string) (time.Time, error) {
+	if day, err := time.Parse("2006-01-02", value); err == nil {
+		return day.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	return parseEventTime(value)
+}
+
+func parseKnownTime(t string) time.Time {
+	ret, _ := time.Parse("_2 Jan 2006", t)
+	return ret
+}
+
+func randomString(length int) string {
+	b := make([]byte, length)
+	rand.Read(b)
+	en := base64.URLEncoding
+	d := make([]byte, en.EncodedLen(len(b)))
+	en.Encode(d, b)
+	return string(d)
+}
+
+func jsonFlaggedProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
 		return
 	}
 
-	createOauthSession(w, r, userConfig)
-	applog.Infof("Redirecting user to %s", url)
+	if !isAdmin(sessionPid) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	http.Redirect(w, r, url, http.StatusFound)
+	startParam := r.FormValue("start")
+	start, err := strconv.ParseInt(startParam, 10, 0)
+	if err != nil {
+		start = 0
+	}
+
+	countParam := r.FormValue("count")
+	count, err := strconv.ParseInt(countParam, 10, 0)
+	if err != nil {
+		count = 10
+	}
 
+	s := datastore.NewRedisStore()
+	defer s.Close()
+	profiles, err := s.FlaggedProfiles(int(start), int(count))
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	json, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
 }
-func soauthHandler(w http.ResponseWriter, r *http.Request) {
-	service := OauthService()
 
-	userConfig, err := readOauthSession(w, r)
+func jsonLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+
+	if !isAdmin(sessionPid) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	startParam := r.FormValue("start")
+	start, err := strconv.ParseInt(startParam, 10, 0)
 	if err != nil {
-		applog.Errorf("Could not read oauth session: %v", err)
-		ErrorResponse(w, r, errors.New("Could not parse authorization"))
+		start = 0
+	}
+
+	countParam := r.FormValue("count")
+	count, err := strconv.ParseInt(countParam, 10, 0)
+	if err != nil {
+		count = 50
+	}
+
+	lockouts, err := Lockouts(int(start), int(count))
+	if err != nil {
+		ErrorResponse(w, r, err)
 		return
 	}
 
-	token, verifier, err := userConfig.ParseAuthorize(r, service)
+	json, err := json.MarshalIndent(lockouts, "", "  ")
 	if err != nil {
-		applog.Errorf("Could not parse authorization: %v", err)
-		ErrorResponse(w, r, errors.New("Could not parse authorization"))
+		ErrorResponse(w, r, err)
 		return
 	}
-	httpClient := new(http.Client)
-	err = userConfig.GetAccessToken(token, verifier, service, httpClient)
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
+}
+
+func jsonSearchHealthHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+
+	if !isAdmin(sessionPid) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	json, err := json.MarshalIndent(ProvidersHealth(), "", "  ")
 	if err != nil {
-		applog.Errorf("Error getting access token: %v", err)
-		ErrorResponse(w, r, errors.New("Problem getting an access token"))
+		ErrorResponse(w, r, err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
+}
 
-	screenName := userConfig.AccessValues.Get("screen_name")
+func jsonProfileSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
 
-	client := twittergo.NewClient(service.ClientConfig, userConfig)
+	countParam := r.FormValue("count")
+	count, err := strconv.ParseInt(countParam, 10, 0)
+	if err != nil {
+		count = 8
+	}
 
-	query := url.Values{}
-	query.Set("screen_name", screenName)
+	city := r.FormValue("loc")
+	if city == "" {
+		if geo, found := geoLocate(clientIP(r)); found {
+			city = geo.City
+		}
+	}
 
-	req, _ := http.NewRequest("GET", fmt.Sprintf("https://api.twitter.com/1.1/users/show.json?%s", query.Encode()), nil)
-	response, err := client.SendRequest(req)
+	list, err := SuggestProfiles(r.FormValue("s"), sessionPid, city, int(count))
 	if err != nil {
 		ErrorResponse(w, r, err)
 		return
 	}
 
-	defer response.Body.Close()
-	contents, err := ioutil.ReadAll(response.Body)
+	json, err := json.MarshalIndent(list, "", "  ")
 	if err != nil {
-		applog.Errorf("Received an error while reading twitter response: %s", err)
 		ErrorResponse(w, r, err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
+}
 
-	twitterUserData := &TwitterUser{}
-	err = json.Unmarshal(contents, twitterUserData)
-
-	if err != nil {
-		ErrorResponse(w, r, err)
+func indexProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
 	}
 
-	pid := datastore.PidType(fmt.Sprintf("@%s", screenName))
+	if !isAdmin(sessionPid) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
 	s := datastore.NewRedisStore()
 	defer s.Close()
 
-	exists, err := s.ProfileExists(pid)
-	if err != nil {
+	if err := reindexProfiles(s); err != nil {
 		ErrorResponse(w, r, err)
 		return
 	}
-	if !exists {
-		pwd, err := RandomString(18)
-		if err != nil {
-			applog.Errorf("Could not generate password: %s", err.Error())
-			ErrorResponse(w, r, err)
-			return
-		}
 
-		err = s.AddProfile(pid, pwd, twitterUserData.Name, twitterUserData.Description, "", "", "", "", twitterUserData.Location, twitterUserData.Url, twitterUserData.ProfileImageUrl, twitterUserData.ProfileImageUrlHttps, "")
-		if err != nil {
-			ErrorResponse(w, r, err)
-			return
-		}
+	fmt.Fprint(w, "ACK")
+}
 
-		cookie := http.Cookie{Name: newUserCookieName, Value: "true", Path: "/", MaxAge: config.Web.Session.Duration}
-		http.SetCookie(w, &cookie)
+func indexItemsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
 
-	} else {
-		values := make(map[string]string, 0)
-		values["name"] = twitterUserData.Name
-		values["bio"] = twitterUserData.Description
-		values["url"] = twitterUserData.Url
-		values["location"] = twitterUserData.Location
-		values["profileimageurl"] = twitterUserData.ProfileImageUrl
-		values["profileimageurlhttps"] = twitterUserData.ProfileImageUrlHttps
+	if !isAdmin(sessionPid) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-		s.UpdateProfile(pid, values)
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	if err := reindexItems(s); err != nil {
+		ErrorResponse(w, r, err)
+		return
 	}
 
-	createSession(pid, w, r)
-	http.Redirect(w, r, "/timeline", http.StatusFound)
+	fmt.Fprint(w, "ACK")
+}
 
+func jsonSearchTopHandler(w http.ResponseWriter, r *http.Request) {
+	searchAnalyticsResponse(w, r, func(report *SearchReport) interface{} {
+		return report.TopQueries
+	})
 }
 
-type TemplateMap map[string]string
+func jsonSearchZeroHandler(w http.ResponseWriter, r *http.Request) {
+	searchAnalyticsResponse(w, r, func(report *SearchReport) interface{} {
+		return report.ZeroResultQueries
+	})
+}
 
-func packageTemplates() (*TemplateMap, error) {
-	filenames, err := filepath.Glob(fmt.Sprintf("%s/*.html", templatesDir))
+func jsonSearchConversionHandler(w http.ResponseWriter, r *http.Request) {
+	searchAnalyticsResponse(w, r, func(report *SearchReport) interface{} {
+		report.TopQueries = nil
+		report.ZeroResultQueries = nil
+		return report
+	})
+}
 
-	if err != nil {
-		return nil, err
+// searchAnalyticsResponse writes the part of the search report chosen by
+// section for the window given by the from and to parameters, which defaults
+// to the last seven days
+func searchAnalyticsResponse(w http.ResponseWriter, r *http.Request, section func(*SearchReport) interface{}) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
 	}
 
-	templateMap := make(TemplateMap, 0)
+	if !isAdmin(sessionPid) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	for _, filename := range filenames {
-		b, err := ioutil.ReadFile(filename)
+	to := time.Now()
+	if toParam := r.FormValue("to"); toParam != "" {
+		t, err := parseEndTime(toParam)
 		if err != nil {
-			return nil, err
+			http.Error(w, "to parameter is not a valid time", http.StatusBadRequest)
+			return
 		}
-
-		templateMap[filename[len(templatesDir)-1:len(filename)-5]] = string(b)
+		to = t
 	}
 
-	return &templateMap, nil
-}
+	from := to.Add(-7 * 24 * time.Hour)
+	if fromParam := r.FormValue("from"); fromParam != "" {
+		t, err := parseEventTime(fromParam)
+		if err != nil {
+			http.Error(w, "from parameter is not a valid time", http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
 
-func templatesHandler(w http.ResponseWriter, r *http.Request) {
-	tm, err := packageTemplates()
+	countParam := r.FormValue("count")
+	count, err := strconv.ParseInt(countParam, 10, 0)
+	if err != nil {
+		count = 20
+	}
+	if count < 1 {
+		count = 1
+	} else if count > maxReportQueries {
+		count = maxReportQueries
+	}
 
+	report, err := SearchAnalytics(from, to, int(count))
 	if err != nil {
 		ErrorResponse(w, r, err)
 		return
 	}
 
-	json, err := json.MarshalIndent(tm, "", "  ")
+	json, err := json.MarshalIndent(section(report), "", "  ")
 	if err != nil {
 		ErrorResponse(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/javascript")
-
-	w.Write([]byte(fmt.Sprintf("window.templates=%s;", json)))
-
+	w.Write(json)
 }
 
-func jsonFeedsHandler(w http.ResponseWriter, r *http.Request) {
-	sessionValid, _ := checkSession(w, r, false)
+func jsonSavedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
 	if !sessionValid {
 		return
 	}
 
 	pid := datastore.PidType(r.FormValue("pid"))
+	if !authorize(w, r, sessionPid, pid) {
+		return
+	}
 
-	s := datastore.NewRedisStore()
-	defer s.Close()
-
-	flist, err := s.Feeds(pid)
+	list, err := SavedSearches(pid)
 	if err != nil {
 		ErrorResponse(w, r, err)
 		return
 	}
 
-	json, err := json.MarshalIndent(flist, "", "  ")
+	json, err := json.MarshalIndent(list, "", "  ")
 	if err != nil {
 		ErrorResponse(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/javascript")
 	w.Write(json)
-
 }
 
-func jsonSearchHandler(w http.ResponseWriter, r *http.Request) {
-	sessionValid, pid := checkSession(w, r, false)
+func saveSearchHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
 	if !sessionValid {
 		return
 	}
 
-	var result SearchResults
-
-	srch := r.FormValue("s")
-	stype := r.FormValue("t")
-
-	if srch == "" {
-		ErrorResponse(w, r, errors.New("Invalid search entered"))
+	pid := datastore.PidType(r.FormValue("pid"))
+	if !authorize(w, r, sessionPid, pid) {
 		return
 	}
 
-	if stype == "p" {
-		result = ProfileSearch(srch)
-	} else {
-		if stype == "v" {
-			result = VideoSearch(srch, pid)
-		} else if stype == "a" {
-			result = AudioSearch(srch, pid)
-		} else if stype == "e" {
-			result = EventSearch(srch, pid)
-		} else {
-			result = ItemSearch(srch, pid)
-		}
-		if items, ok := result.Results.(ItemSearchResults); ok {
-			s := datastore.NewRedisStore()
-			defer s.Close()
-
-			fitems := make(FormattedItemSearchResults, 0)
-
-			for _, item := range items {
-				s.SaveItem(item, config.Search.Lifetime)
-
-				fitem, err := s.FormatItem(item, 0, item.Pid)
-				if err != nil {
-					continue
-				}
-				fitems = append(fitems, fitem)
-			}
-
-			result.Results = fitems
-		}
-
+	ss, err := AddSavedSearch(pid, r.FormValue("s"), r.FormValue("t"), r.FormValue("delivery"))
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
 	}
 
-	json, err := json.MarshalIndent(result, "", "  ")
+	json, err := json.MarshalIndent(ss, "", "  ")
 	if err != nil {
 		ErrorResponse(w, r, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/javascript")
 	w.Write(json)
-
 }
 
-func isAdmin(pid datastore.PidType) bool {
-	for _, v := range config.Web.Admins {
-		if datastore.PidType(v) == pid {
-			return true
-		}
+func remSearchHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
 	}
 
-	return false
-}
+	pid := datastore.PidType(r.FormValue("pid"))
+	if !authorize(w, r, sessionPid, pid) {
+		return
+	}
 
-func parseKnownTime(t string) time.Time {
-	ret, _ := time.Parse("_2 Jan 2006", t)
-	return ret
-}
+	if err := RemoveSavedSearch(pid, r.FormValue("id")); err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
 
-func randomString(length int) string {
-	b := make([]byte, length)
-	rand.Read(b)
-	en := base64.URLEncoding
-	d := make([]byte, en.EncodedLen(len(b)))
-	en.Encode(d, b)
-	return string(d)
+	fmt.Fprint(w, "ACK")
 }
 
-func jsonFlaggedProfilesHandler(w http.ResponseWriter, r *http.Request) {
+func jsonNotificationsHandler(w http.ResponseWriter, r *http.Request) {
 	sessionValid, sessionPid := checkSession(w, r, false)
 	if !sessionValid {
 		return
 	}
 
-	if !isAdmin(sessionPid) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	pid := datastore.PidType(r.FormValue("pid"))
+	if !authorize(w, r, sessionPid, pid) {
 		return
 	}
 
-	startParam := r.FormValue("start")
-	start, err := strconv.ParseInt(startParam, 10, 0)
+	countParam := r.FormValue("count")
+	count, err := strconv.ParseInt(countParam, 10, 0)
 	if err != nil {
-		start = 0
+		count = 20
 	}
 
-	countParam := r.FormValue("count")
-	count, err := strconv.ParseInt(countParam, 10, 0)
+	startParam := r.FormValue("start")
+	start, err := strconv.ParseInt(startParam, 10, 0)
 	if err != nil {
-		count = 10
+		start = 0
 	}
 
-	s := datastore.NewRedisStore()
-	defer s.Close()
-	profiles, err := s.FlaggedProfiles(int(start), int(count))
+	list, err := Notifications(pid, int(start), int(count))
 	if err != nil {
 		ErrorResponse(w, r, err)
 		return
 	}
 
-	json, err := json.MarshalIndent(profiles, "", "  ")
+	json, err := json.MarshalIndent(list, "", "  ")
 	if err != nil {
 		ErrorResponse(w, r, err)
 		return
@@ -1438,6 +2617,25 @@ func jsonFlaggedProfilesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(json)
 }
 
+func clearNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionValid, sessionPid := checkSession(w, r, false)
+	if !sessionValid {
+		return
+	}
+
+	pid := datastore.PidType(r.FormValue("pid"))
+	if !authorize(w, r, sessionPid, pid) {
+		return
+	}
+
+	if err := ClearNotifications(pid); err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+
+	fmt.Fprint(w, "ACK")
+}
+
 func OauthService() *oauth1a.Service {
 	return &oauth1a.Service{
 		RequestURL:   "https://api.twitter.com/oauth/request_token",
@@ -1490,38 +2688,99 @@ func jsonGeoHandler(w http.ResponseWriter, r *http.Request) {
 	ipAddr := r.FormValue("ip")
 
 	if ipAddr == "" {
+		ipAddr = clientIP(r)
+	}
+
+	locformatted, _ := geoLocate(ipAddr)
+
+	json, err := json.MarshalIndent(locformatted, "", "  ")
+	if err != nil {
+		ErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(json)
+}
 
-		if v, exists := r.Header["X-Forwarded-For"]; exists {
-			ipAddr = v[0]
-		} else {
-			ipAddr = strings.Split(r.RemoteAddr, ":")[0]
+// clientIP returns the address of the client that made the request, taking
+// account of any proxy in front of the server
+// remoteIP returns the address of the client that made the request. The
+// X-Forwarded-For header is only used when the request comes from a trusted
+// proxy, in which case the right-most address that is not a trusted proxy is
+// the client.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
 
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		if net.ParseIP(addr) == nil {
+			// Anything before a malformed entry cannot be trusted
+			return host
 		}
+		if !trustedProxy(addr) {
+			return addr
+		}
+		host = addr
 	}
+	return host
+}
 
-	locformatted := GeoLocation{
-		IPAddr: ipAddr,
+// trustedProxy reports whether addr is one of the configured trusted proxies
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
 	}
 
-	loc := cityDb.GetLocationByIP(ipAddr)
+	for _, proxy := range config.Web.TrustedProxies {
+		if strings.Contains(proxy, "/") {
+			if _, network, err := net.ParseCIDR(proxy); err == nil && network.Contains(ip) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
 
-	if loc != nil {
-		locformatted.CountryCode = loc.CountryCode
-		locformatted.CountryName = loc.CountryName
-		locformatted.Region = loc.Region
-		locformatted.City = loc.City
-		locformatted.PostalCode = loc.PostalCode
-		locformatted.Latitude = loc.Latitude
-		locformatted.Longitude = loc.Longitude
+func clientIP(r *http.Request) string {
+	if v, exists := r.Header["X-Forwarded-For"]; exists {
+		return v[0]
 	}
+	return strings.Split(r.RemoteAddr, ":")[0]
+}
 
-	json, err := json.MarshalIndent(locformatted, "", "  ")
-	if err != nil {
-		ErrorResponse(w, r, err)
-		return
+// geoLocate looks up the location of an IP address in the city database. The
+// boolean result is false if the address could not be found.
+func geoLocate(ipAddr string) (GeoLocation, bool) {
+	locformatted := GeoLocation{
+		IPAddr: ipAddr,
 	}
-	w.Header().Set("Content-Type", "application/javascript")
-	w.Write(json)
+
+	loc := cityDb.GetLocationByIP(ipAddr)
+	if loc == nil {
+		return locformatted, false
+	}
+
+	locformatted.CountryCode = loc.CountryCode
+	locformatted.CountryName = loc.CountryName
+	locformatted.Region = loc.Region
+	locformatted.City = loc.City
+	locformatted.PostalCode = loc.PostalCode
+	locformatted.Latitude = loc.Latitude
+	locformatted.Longitude = loc.Longitude
+	return locformatted, true
 }
 
 func jsonDetectHandler(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"cgl.tideland.biz/applog"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The profile index maps every prefix of a profile's pid and of each word of
+// its name to a sorted set of pids scored by follower count, so the most
+// followed profiles are found first. A hash holds the details of each indexed
+// profile needed to rank and display suggestions without using the datastore.
+
+// Longest prefix indexed. Longer searches are matched on this prefix.
+const maxProfilePrefix = 15
+
+// Number of most followed matching profiles ranked for each suggestion
+const maxSuggestCandidates = 50
+
+// Most suggestions returned
+const maxSuggestions = 20
+
+// Profiles followed by each searcher, keyed by pid
+var followingCache = NewCache(time.Minute, 0)
+
+type ProfileSuggestion struct {
+	Pid       datastore.PidType `json:"pid"`
+	Name      string            `json:"name"`
+	Location  string            `json:"location,omitempty"`
+	Followers int               `json:"followers"`
+	Following bool              `json:"following"`
+
+	score float64
+}
+
+func profilePrefixKey(prefix string) string {
+	return redisKey("profileindex", "prefix", prefix)
+}
+
+func profileIndexKey() string {
+	return redisKey("profileindex", "profiles")
+}
+
+// profilePrefixes returns every prefix of the profile's pid and name words
+func profilePrefixes(pid datastore.PidType, name string) []string {
+	seen := make(map[string]bool)
+	prefixes := make([]string, 0)
+
+	words := append(searchTokens(name), searchTokens(string(pid))...)
+
+	for _, w := range words {
+		runes := []rune(w)
+		for i := 1; i <= len(runes) && i <= maxProfilePrefix; i++ {
+			p := string(runes[:i])
+			if !seen[p] {
+				seen[p] = true
+				prefixes = append(prefixes, p)
+			}
+		}
+	}
+	return prefixes
+}
+
+// indexProfile adds the profile to the profile index, replacing any previous
+// entries for it
+func indexProfile(s *datastore.RedisStore, pid datastore.PidType) error {
+	profile, err := s.Profile(pid)
+	if err != nil {
+		return err
+	}
+
+	// Only the first maxIndexFollowing followers are counted
+	followers, err := s.Followers(pid, maxIndexFollowing, 0)
+	if err != nil {
+		return err
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	old, err := indexedProfile(conn, pid)
+	if err != nil {
+		return err
+	}
+
+	entry := &ProfileSuggestion{Pid: pid, Name: profile.Name, Location: profile.Location, Followers: len(followers)}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	prefixes := profilePrefixes(pid, profile.Name)
+	current := make(map[string]bool, len(prefixes))
+	for _, p := range prefixes {
+		current[p] = true
+	}
+
+	conn.Send("MULTI")
+	if old != nil {
+		for _, p := range profilePrefixes(old.Pid, old.Name) {
+			if !current[p] {
+				conn.Send("ZREM", profilePrefixKey(p), pid)
+			}
+		}
+	}
+	for _, p := range prefixes {
+		conn.Send("ZADD", profilePrefixKey(p), entry.Followers, pid)
+	}
+	conn.Send("HSET", profileIndexKey(), pid, data)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// unindexProfile removes the profile from the profile index
+func unindexProfile(pid datastore.PidType) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	old, err := indexedProfile(conn, pid)
+	if err != nil || old == nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	for _, p := range profilePrefixes(old.Pid, old.Name) {
+		conn.Send("ZREM", profilePrefixKey(p), pid)
+	}
+	conn.Send("HDEL", profileIndexKey(), pid)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// indexedProfile returns the indexed details of a profile or nil if it has
+// not been indexed
+func indexedProfile(conn redis.Conn, pid datastore.PidType) (*ProfileSuggestion, error) {
+	data, err := redis.Bytes(conn.Do("HGET", profileIndexKey(), pid))
+	if err != nil {
+		if err == redis.ErrNil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	entry := &ProfileSuggestion{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// reindexProfiles rebuilds the profile index from every profile in the
+// datastore
+func reindexProfiles(s *datastore.RedisStore) error {
+	if err := clearProfileIndex(); err != nil {
+		return err
+	}
+
+	// Every profile contains the empty string
+	plist, err := s.FindProfilesBySubstring("")
+	if err != nil {
+		return err
+	}
+
+	for _, p := range plist {
+		if err := indexProfile(s, p.Pid); err != nil {
+			applog.Errorf("Could not index profile %s: %s", p.Pid, err.Error())
+		}
+	}
+	applog.Infof("Indexed %d profiles", len(plist))
+	return nil
+}
+
+// clearProfileIndex removes the entire profile index
+func clearProfileIndex() error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("KEYS", redisKey("profileindex", "*")))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if _, err := conn.Do("DEL", key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// followingPids returns the set of profiles followed by pid
+func followingPids(s *datastore.RedisStore, pid datastore.PidType) map[datastore.PidType]bool {
+	if value, found, _ := followingCache.Get(string(pid)); found {
+		return value.(map[datastore.PidType]bool)
+	}
+
+	pids := make(map[datastore.PidType]bool)
+	following, err := s.Following(pid, maxIndexFollowing, 0)
+	if err != nil {
+		applog.Errorf("Could not fetch profiles followed by %s: %s", pid, err.Error())
+		return pids
+	}
+	for _, p := range following {
+		pids[p.Pid] = true
+	}
+
+	followingCache.Set(string(pid), pids)
+	return pids
+}
+
+// SuggestProfiles returns up to count profiles whose pid or name start with
+// the words of srch. Profiles are ranked by their number of followers, with
+// those already followed by pid and those whose location mentions city
+// ranked higher.
+func SuggestProfiles(srch string, pid datastore.PidType, city string, count int) ([]*ProfileSuggestion, error) {
+	suggestions := make([]*ProfileSuggestion, 0)
+
+	words := searchTokens(srch)
+	if len(words) == 0 {
+		return suggestions, nil
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	key := profilePrefixKey(prefixOf(words[0]))
+	if len(words) > 1 {
+		key = redisKey("profileindex", "tmp", randomString(6))
+
+		args := redis.Args{}.Add(key, len(words))
+		for _, w := range words {
+			args = args.Add(profilePrefixKey(prefixOf(w)))
+		}
+		args = args.Add("AGGREGATE", "MAX")
+
+		if _, err := conn.Do("ZINTERSTORE", args...); err != nil {
+			return nil, err
+		}
+		defer conn.Do("DEL", key)
+	}
+
+	pids, err := redis.Strings(conn.Do("ZREVRANGE", key, 0, maxSuggestCandidates-1))
+	if err != nil || len(pids) == 0 {
+		return suggestions, err
+	}
+
+	args := redis.Args{}.Add(profileIndexKey())
+	for _, p := range pids {
+		args = args.Add(p)
+	}
+	entries, err := redis.Strings(conn.Do("HMGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	var following map[datastore.PidType]bool
+	if pid != "" {
+		s := datastore.NewRedisStore()
+		defer s.Close()
+		following = followingPids(s, pid)
+	}
+
+	city = strings.ToLower(city)
+	for _, data := range entries {
+		if data == "" {
+			continue
+		}
+
+		entry := &ProfileSuggestion{}
+		if err := json.Unmarshal([]byte(data), entry); err != nil || entry.Pid == pid {
+			continue
+		}
+
+		entry.Following = following[entry.Pid]
+		entry.score = math.Log1p(float64(entry.Followers))
+		if entry.Following {
+			entry.score += 3
+		}
+		if city != "" && strings.Contains(strings.ToLower(entry.Location), city) {
+			entry.score += 1.5
+		}
+		suggestions = append(suggestions, entry)
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool { return suggestions[i].score > suggestions[j].score })
+
+	if count <= 0 || count > maxSuggestions {
+		count = maxSuggestions
+	}
+	if len(suggestions) > count {
+		suggestions = suggestions[:count]
+	}
+	return suggestions, nil
+}
+
+func prefixOf(word string) string {
+	runes := []rune(word)
+	if len(runes) > maxProfilePrefix {
+		runes = runes[:maxProfilePrefix]
+	}
+	return string(runes)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"cgl.tideland.biz/applog"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A SearchProvider is an external source of items for /-jsearch
+type SearchProvider interface {
+	// Name identifies the provider in logs and configuration
+	Name() string
+
+	// Media lists the item media types the provider can return
+	Media() []string
+
+	// Enabled reports whether the provider should be used for searches
+	Enabled() bool
+
+	// Search returns a page of items matching the query. Implementations
+	// should abandon the search and return ctx.Err() once the context is done.
+	Search(ctx context.Context, q SearchQuery) (*SearchPage, error)
+}
+
+var (
+	searchProvidersMutex sync.RWMutex
+	searchProviders      []SearchProvider
+	searchClient         = http.DefaultClient
+
+	// Pages of recent search results, keyed by provider, media, offset and query
+	searchCache = NewCache(0, 0)
+)
+
+// Maps the single letter t parameter of /-jsearch to a media type
+var searchMediaTypes = map[string]string{
+	"v": "video",
+	"a": "audio",
+	"e": "event",
+}
+
+type funcSearchProvider struct {
+	name    string
+	media   []string
+	enabled bool
+	client  *http.Client
+	search  SearchFunc
+}
+
+func (p *funcSearchProvider) Name() string    { return p.name }
+func (p *funcSearchProvider) Media() []string { return p.media }
+func (p *funcSearchProvider) Enabled() bool   { return p.enabled }
+func (p *funcSearchProvider) Search(ctx context.Context, q SearchQuery) (*SearchPage, error) {
+	return p.search(ctx, p.client, q)
+}
+
+// NewSearchProvider wraps a SearchFunc as a SearchProvider that makes its
+// requests with client
+func NewSearchProvider(name string, media []string, enabled bool, client *http.Client, f SearchFunc) SearchProvider {
+	return &funcSearchProvider{name: name, media: media, enabled: enabled, client: client, search: f}
+}
+
+func RegisterSearchProvider(p SearchProvider) {
+	searchProvidersMutex.Lock()
+	defer searchProvidersMutex.Unlock()
+
+	for i, existing := range searchProviders {
+		if existing.Name() == p.Name() {
+			searchProviders[i] = p
+			return
+		}
+	}
+	searchProviders = append(searchProviders, p)
+}
+
+// SearchClient returns the http client used to make requests to providers
+func SearchClient() *http.Client {
+	searchProvidersMutex.RLock()
+	defer searchProvidersMutex.RUnlock()
+	return searchClient
+}
+
+// SearchProviders returns the enabled providers that can return the given
+// media type. An empty media type matches every enabled provider.
+func SearchProviders(media string) []SearchProvider {
+	searchProvidersMutex.RLock()
+	defer searchProvidersMutex.RUnlock()
+
+	providers := make([]SearchProvider, 0, len(searchProviders))
+	for _, p := range searchProviders {
+		if !p.Enabled() {
+			continue
+		}
+		if media == "" || providesMedia(p, media) {
+			providers = append(providers, p)
+		}
+	}
+	return providers
+}
+
+func providesMedia(p SearchProvider, media string) bool {
+	for _, m := range p.Media() {
+		if m == media {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedSearchProvider serves a provider's results from searchCache,
+// refreshing stale results in the background
+type cachedSearchProvider struct {
+	SearchProvider
+	media string
+}
+
+// CachedSearchProvider wraps p so that its results for the given media type
+// are shared between searches
+func CachedSearchProvider(p SearchProvider, media string) SearchProvider {
+	return &cachedSearchProvider{SearchProvider: p, media: media}
+}
+
+func (p *cachedSearchProvider) Search(ctx context.Context, q SearchQuery) (*SearchPage, error) {
+	key := searchCacheKey(q, p.media, p.Name())
+
+	if value, found, refresh := searchCache.Get(key); found {
+		if refresh {
+			go p.refresh(key, q)
+		}
+		return value.(*SearchPage), nil
+	}
+
+	page, err := p.SearchProvider.Search(ctx, q)
+	if err != nil {
+		return page, err
+	}
+
+	searchCache.Set(key, page)
+	return page, nil
+}
+
+func (p *cachedSearchProvider) refresh(key string, q SearchQuery) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Search.Timeout)*time.Millisecond)
+	defer cancel()
+
+	page, err := p.SearchProvider.Search(ctx, q)
+	if err != nil {
+		applog.Debugf("Background refresh of %s search for %s failed: %s", p.Name(), q, err.Error())
+		searchCache.Abandon(key)
+		return
+	}
+	searchCache.Set(key, page)
+}
+
+func searchCacheKey(q SearchQuery, media string, name string) string {
+	return fmt.Sprintf("%s|%s|%d|%s", name, media, q.Offset, normalizeSearch(q.String()))
+}
+
+// normalizeSearch folds case and whitespace so that trivially different
+// searches share cache entries
+func normalizeSearch(srch string) string {
+	return strings.Join(strings.Fields(strings.ToLower(srch)), " ")
+}
+
+// initSearchProviders replaces the registered providers with those described
+// by the search configuration, each making its requests with client. It is
+// called each time configuration is read.
+func initSearchProviders(c SearchConfig, client *http.Client) {
+	searchCache.SetLifetime(time.Duration(c.Lifetime)*time.Second, time.Duration(c.StaleLifetime)*time.Second)
+
+	searchProvidersMutex.Lock()
+	searchProviders = nil
+	searchClient = client
+	searchProvidersMutex.Unlock()
+
+	RegisterSearchProvider(NewSearchProvider(c.Youtube.Pid, []string{"video"}, c.Youtube.Enabled, client, searchYoutubeVidoes))
+	RegisterSearchProvider(NewSearchProvider(c.Eventful.Pid, []string{"event"}, c.Eventful.Enabled, client, searchEventfulEvents))
+	RegisterSearchProvider(NewSearchProvider(c.Songkick.Pid, []string{"event"}, c.Songkick.Enabled, client, searchSongkickEvents))
+	RegisterSearchProvider(NewSearchProvider(c.Spotify.Pid, []string{"audio"}, c.Spotify.Enabled, client, searchSpotifyTracks))
+	RegisterSearchProvider(NewSearchProvider(c.Lastfm.Pid, []string{"audio", "event"}, c.Lastfm.Enabled, client, searchLastfm))
+}
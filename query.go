@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"github.com/placetime/datastore"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Searches may contain operators that restrict the results:
+//
+//   media:video        only items of the given media type
+//   after:2014-05-01   only events starting after the date
+//   before:2014-06-01  only events starting before the date
+//   near:london        only events near the place
+//   from:@pid          only items from the profile
+//   "some phrase"      only items containing the exact phrase
+//   -word, -"phrase"   no items containing the word or phrase
+//
+// Operator values may be quoted. Anything else is searched for as text.
+
+// ParseSearchQuery parses a search entered by a user
+func ParseSearchQuery(srch string) SearchQuery {
+	q := SearchQuery{}
+	terms := make([]string, 0)
+
+	for _, tok := range splitSearch(srch) {
+		if tok.exclude {
+			if tok.value != "" {
+				q.Exclude = append(q.Exclude, tok.value)
+			}
+			continue
+		}
+
+		if tok.quoted {
+			if tok.value != "" {
+				q.Phrases = append(q.Phrases, tok.value)
+			}
+			continue
+		}
+
+		if tok.key != "" && applySearchOperator(&q, tok.key, tok.value) {
+			continue
+		}
+
+		terms = append(terms, tok.raw)
+	}
+
+	q.Text = strings.Join(terms, " ")
+	return q
+}
+
+// applySearchOperator sets the part of the query named by key, returning
+// false if the key is not a known operator or its value is invalid
+func applySearchOperator(q *SearchQuery, key string, value string) bool {
+	switch strings.ToLower(key) {
+	case "media":
+		if media, exists := searchMediaTypes[value]; exists {
+			value = media
+		}
+		for _, media := range searchMediaTypes {
+			if media == value {
+				q.Media = media
+				return true
+			}
+		}
+	case "after":
+		if t, err := parseEventTime(value); err == nil {
+			q.From = t
+			return true
+		}
+	case "before":
+		if t, err := parseEventTime(value); err == nil {
+			q.To = t
+			return true
+		}
+	case "near":
+		if value != "" {
+			q.Location = &SearchLocation{Name: value}
+			return true
+		}
+	case "from":
+		if value != "" {
+			q.Pid = datastore.PidType(strings.ToLower(value))
+			return true
+		}
+	}
+	return false
+}
+
+type searchToken struct {
+	raw     string // the token as entered
+	key     string // operator name, if any
+	value   string // operator value, phrase or word
+	quoted  bool
+	exclude bool
+}
+
+// splitSearch breaks a search into words, quoted phrases and operators
+func splitSearch(srch string) []searchToken {
+	tokens := make([]searchToken, 0)
+	runes := []rune(srch)
+
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		tok := searchToken{}
+
+		if runes[i] == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			tok.exclude = true
+			i++
+		}
+
+		if runes[i] == '"' {
+			tok.quoted = true
+			i++
+			valueStart := i
+			for i < len(runes) && runes[i] != '"' {
+				i++
+			}
+			tok.value = strings.TrimSpace(string(runes[valueStart:i]))
+			if i < len(runes) {
+				i++
+			}
+			tok.raw = string(runes[start:i])
+			tokens = append(tokens, tok)
+			continue
+		}
+
+		wordStart := i
+		for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != ':' {
+			i++
+		}
+
+		if !tok.exclude && i < len(runes) && runes[i] == ':' && i > wordStart {
+			tok.key = string(runes[wordStart:i])
+			i++
+			if i < len(runes) && runes[i] == '"' {
+				i++
+				valueStart := i
+				for i < len(runes) && runes[i] != '"' {
+					i++
+				}
+				tok.value = string(runes[valueStart:i])
+				if i < len(runes) {
+					i++
+				}
+			} else {
+				valueStart := i
+				for i < len(runes) && !unicode.IsSpace(runes[i]) {
+					i++
+				}
+				tok.value = string(runes[valueStart:i])
+			}
+		} else {
+			for i < len(runes) && !unicode.IsSpace(runes[i]) {
+				i++
+			}
+			tok.value = string(runes[wordStart:i])
+		}
+
+		tok.raw = string(runes[start:i])
+		tokens = append(tokens, tok)
+	}
+
+	return tokens
+}
+
+// PlainText returns the words and phrases of the query without quotes, for
+// providers that have no phrase syntax
+func (q SearchQuery) PlainText() string {
+	parts := make([]string, 0, len(q.Phrases)+1)
+	if q.Text != "" {
+		parts = append(parts, q.Text)
+	}
+	parts = append(parts, q.Phrases...)
+	return strings.Join(parts, " ")
+}
+
+// Keywords returns the words of the query with its phrases quoted
+func (q SearchQuery) Keywords() string {
+	parts := make([]string, 0, len(q.Phrases)+1)
+	if q.Text != "" {
+		parts = append(parts, q.Text)
+	}
+	for _, p := range q.Phrases {
+		parts = append(parts, fmt.Sprintf("%q", p))
+	}
+	return strings.Join(parts, " ")
+}
+
+// KeywordsWithExclusions returns Keywords followed by the excluded words and
+// phrases, each prefixed with a minus sign
+func (q SearchQuery) KeywordsWithExclusions() string {
+	parts := []string{q.Keywords()}
+	for _, e := range q.Exclude {
+		if strings.ContainsAny(e, " \t") {
+			parts = append(parts, fmt.Sprintf("-%q", e))
+		} else {
+			parts = append(parts, "-"+e)
+		}
+	}
+	return strings.TrimSpace(strings.Join(parts, " "))
+}
+
+// String returns the query in canonical search syntax
+func (q SearchQuery) String() string {
+	parts := []string{q.KeywordsWithExclusions()}
+	if q.Media != "" {
+		parts = append(parts, "media:"+q.Media)
+	}
+	if !q.From.IsZero() {
+		parts = append(parts, "after:"+q.From.UTC().Format(time.RFC3339))
+	}
+	if !q.To.IsZero() {
+		parts = append(parts, "before:"+q.To.UTC().Format(time.RFC3339))
+	}
+	if q.Location != nil {
+		parts = append(parts, fmt.Sprintf("near:%q", q.Location.String()))
+		if q.Radius > 0 {
+			parts = append(parts, fmt.Sprintf("radius:%d", q.Radius))
+		}
+	}
+	if q.Pid != "" {
+		parts = append(parts, "from:"+string(q.Pid))
+	}
+	return strings.TrimSpace(strings.Join(parts, " "))
+}
+
+// Matches reports whether an item meets the restrictions of the query that
+// can be checked against the item itself. It is used to apply restrictions
+// that a provider could not.
+func (q SearchQuery) Matches(item *datastore.Item) bool {
+	if q.Media != "" && item.Media != q.Media {
+		return false
+	}
+
+	if q.Pid != "" && item.Pid != q.Pid {
+		return false
+	}
+
+	if q.HasDateRange() {
+		if item.Event == 0 {
+			return false
+		}
+		from, to := q.DateRange()
+		t := itemEventTime(item)
+		if t.Before(from) || t.After(to) {
+			return false
+		}
+	}
+
+	if len(q.Phrases) == 0 && len(q.Exclude) == 0 {
+		return true
+	}
+
+	text := " " + strings.Join(searchTokens(item.Text), " ") + " "
+	for _, p := range q.Phrases {
+		if !strings.Contains(text, " "+strings.Join(searchTokens(p), " ")+" ") {
+			return false
+		}
+	}
+	for _, e := range q.Exclude {
+		if strings.Contains(text, " "+strings.Join(searchTokens(e), " ")+" ") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// filterItems returns the items that match the query
+func filterItems(items ItemSearchResults, q SearchQuery) ItemSearchResults {
+	filtered := make(ItemSearchResults, 0, len(items))
+	for _, item := range items {
+		if q.Matches(item) {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
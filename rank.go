@@ -0,0 +1,231 @@
+package main
+
+import (
+	"github.com/placetime/datastore"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Score given to items that have no event time, so that they rank
+// alongside events that are a month or so away
+const undatedScore = 0.5
+
+type rankedItem struct {
+	item  *datastore.Item
+	score float64
+	order int
+}
+
+type rankedItems []*rankedItem
+
+func (r rankedItems) Len() int      { return len(r) }
+func (r rankedItems) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r rankedItems) Less(i, j int) bool {
+	if r[i].score != r[j].score {
+		return r[i].score > r[j].score
+	}
+	return r[i].order < r[j].order
+}
+
+// RankSearchResults merges the lists of items returned by each provider,
+// combining near-duplicates and ordering the remainder by relevance to the
+// search. names holds the name of the provider that returned each list.
+func RankSearchResults(srch string, lists []ItemSearchResults, names []string) ItemSearchResults {
+	rc := config.Search.Ranking
+	query := searchTokens(srch)
+	phrase := strings.Join(query, " ")
+	now := time.Now()
+
+	ranked := make(rankedItems, 0)
+	seen := make(map[string]*rankedItem)
+
+	// Visit the lists round-robin so that equal scores keep the fairness of
+	// the original interleaving
+	order := 0
+	added := true
+	for i := 0; added; i++ {
+		added = false
+		for l, list := range lists {
+			if i >= len(list) {
+				continue
+			}
+			added = true
+
+			item := list[i]
+			key := duplicateKey(item)
+			if existing, exists := seen[key]; exists {
+				existing.item = mergeItems(existing.item, item)
+				continue
+			}
+
+			score := rc.TextWeight*textScore(query, phrase, item.Text) +
+				rc.DateWeight*dateScore(item, now) +
+				rc.MediaWeight*weightOrDefault(rc.Media, item.Media)
+			score *= weightOrDefault(rc.Providers, names[l])
+
+			r := &rankedItem{item: item, score: score, order: order}
+			order++
+			seen[key] = r
+			ranked = append(ranked, r)
+		}
+	}
+
+	sort.Sort(ranked)
+
+	results := make(ItemSearchResults, len(ranked))
+	for i, r := range ranked {
+		results[i] = r.item
+	}
+	return results
+}
+
+// textScore measures how well text matches the search, favouring text that
+// contains every search term and little else
+func textScore(query []string, phrase string, text string) float64 {
+	if len(query) == 0 {
+		return 0
+	}
+
+	terms := searchTokens(text)
+	if len(terms) == 0 {
+		return 0
+	}
+
+	present := make(map[string]bool, len(terms))
+	for _, t := range terms {
+		present[t] = true
+	}
+
+	matched := 0
+	for _, q := range query {
+		if present[q] {
+			matched++
+		}
+	}
+
+	coverage := float64(matched) / float64(len(query))
+	precision := float64(matched) / float64(len(present))
+
+	score := 0.7*coverage + 0.3*precision
+	if strings.Contains(strings.Join(terms, " "), phrase) {
+		score += 0.2
+	}
+
+	return math.Min(score, 1)
+}
+
+// dateScore favours events happening soon over those far in the future and
+// gives nothing to events that have already happened
+func dateScore(item *datastore.Item, now time.Time) float64 {
+	if item.Event == 0 {
+		return undatedScore
+	}
+
+	until := itemEventTime(item).Sub(now)
+	if until < -24*time.Hour {
+		return 0
+	}
+	if until < 0 {
+		until = 0
+	}
+
+	days := until.Hours() / 24
+	return 1 / (1 + days/30)
+}
+
+// itemEventTime converts the event timestamp of an item, which is held in
+// nanoseconds
+func itemEventTime(item *datastore.Item) time.Time {
+	return time.Unix(0, item.Event)
+}
+
+func weightOrDefault(weights map[string]float64, key string) float64 {
+	if w, exists := weights[key]; exists {
+		return w
+	}
+	return 1
+}
+
+// duplicateKey identifies items that describe the same thing, regardless of
+// word order, punctuation or bracketed qualifiers such as "(Live)"
+func duplicateKey(item *datastore.Item) string {
+	terms := searchTokens(stripBracketed(item.Text))
+	sort.Strings(terms)
+
+	key := item.Media + "|" + strings.Join(terms, " ")
+	if item.Event != 0 {
+		key += "|" + itemEventTime(item).UTC().Format("2006-01-02")
+	}
+	return key
+}
+
+// mergeItems returns the richer of two duplicate items, filling any gaps from
+// the other. The items may be shared with the search cache so neither is
+// modified.
+func mergeItems(a *datastore.Item, b *datastore.Item) *datastore.Item {
+	if itemRichness(b) > itemRichness(a) {
+		a, b = b, a
+	}
+
+	merged := *a
+	if merged.Image == "" {
+		merged.Image = b.Image
+	}
+	if merged.Link == "" {
+		merged.Link = b.Link
+	}
+	if merged.Duration == 0 {
+		merged.Duration = b.Duration
+	}
+	if merged.Event == 0 {
+		merged.Event = b.Event
+	}
+	return &merged
+}
+
+func itemRichness(item *datastore.Item) int {
+	richness := len(item.Text)
+	if item.Image != "" {
+		richness += 100
+	}
+	if item.Link != "" {
+		richness += 100
+	}
+	if item.Duration != 0 {
+		richness += 50
+	}
+	if item.Event != 0 {
+		richness += 50
+	}
+	return richness
+}
+
+// searchTokens splits text into lower case words
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func stripBracketed(text string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range text {
+		switch r {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			if depth > 0 {
+				depth--
+			}
+		default:
+			if depth == 0 {
+				b.WriteRune(r)
+			}
+		}
+	}
+	return b.String()
+}
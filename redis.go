@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"time"
+)
+
+// Data owned by the server itself, such as the item text index, is kept in
+// redis alongside the datastore under keys starting with the configured prefix
+
+var redisPool *redis.Pool
+
+func initRedisPool(c RedisConfig) {
+	old := redisPool
+
+	redisPool = &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			conn, err := redis.Dial("tcp", c.Address)
+			if err != nil {
+				return nil, err
+			}
+			if c.Database != 0 {
+				if _, err := conn.Do("SELECT", c.Database); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			return conn, nil
+		},
+		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+
+	if old != nil {
+		old.Close()
+	}
+}
+
+// redisKey joins the parts of a key and adds the configured prefix
+func redisKey(parts ...string) string {
+	return config.Redis.Prefix + strings.Join(parts, ":")
+}
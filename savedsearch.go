@@ -0,0 +1,427 @@
+package main
+
+import (
+	"cgl.tideland.biz/applog"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"time"
+)
+
+// Saved searches are re-run in the background. Results that have not been
+// seen before for a saved search are delivered to the profile that saved it,
+// either by adding them to the profile's timeline or by adding them to the
+// profile's notification list. The first run only records the results seen
+// so that existing results are not delivered, and lasts until every provider
+// has answered so that a provider that was down does not later deliver all
+// of its existing results. Results are forgotten once the search has not
+// returned them for savedSearchSeenRetention seconds.
+
+const (
+	DeliverTimeline = "timeline"
+	DeliverNotify   = "notify"
+)
+
+var ErrTooManySavedSearches = errors.New("Too many saved searches")
+
+type SavedSearch struct {
+	Id       string            `json:"id"`
+	Pid      datastore.PidType `json:"pid"`
+	Query    string            `json:"query"`
+	Type     string            `json:"type"`
+	Delivery string            `json:"delivery"`
+	Created  int64             `json:"created"`
+	LastRun  int64             `json:"lastrun"`
+}
+
+// A Notification tells a profile about a new result for a saved search
+type Notification struct {
+	SearchId string          `json:"searchid"`
+	Query    string          `json:"query"`
+	Item     *datastore.Item `json:"item"`
+	Ts       int64           `json:"ts"`
+}
+
+// Most results remembered as seen for each saved search
+const maxSavedSearchSeen = 1000
+
+// Seconds a result is remembered as seen after the search last returned it
+const savedSearchSeenRetention = 30 * 24 * 60 * 60
+
+func savedSearchKey(id string) string {
+	return redisKey("savedsearch", id)
+}
+
+func savedSearchSeenKey(id string) string {
+	return redisKey("savedsearch", id, "seen")
+}
+
+func profileSavedSearchesKey(pid datastore.PidType) string {
+	return redisKey("savedsearches", string(pid))
+}
+
+func savedSearchScheduleKey() string {
+	return redisKey("savedsearches", "schedule")
+}
+
+func notificationsKey(pid datastore.PidType) string {
+	return redisKey("notifications", string(pid))
+}
+
+// AddSavedSearch saves a search for a profile and schedules its first run
+func AddSavedSearch(pid datastore.PidType, query string, stype string, delivery string) (*SavedSearch, error) {
+	if _, exists := searchMediaTypes[stype]; stype != "" && !exists {
+		return nil, fmt.Errorf("Searches of type %s cannot be saved", stype)
+	}
+
+	if delivery == "" {
+		delivery = DeliverTimeline
+	}
+	if delivery != DeliverTimeline && delivery != DeliverNotify {
+		return nil, fmt.Errorf("Unknown delivery %s", delivery)
+	}
+
+	q := ParseSearchQuery(query)
+	if q.PlainText() == "" {
+		return nil, errors.New("Invalid search entered")
+	}
+
+	if err := ResolveLocation(context.Background(), SearchClient(), q.Location); err != nil {
+		return nil, err
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	count, err := redis.Int(conn.Do("SCARD", profileSavedSearchesKey(pid)))
+	if err != nil {
+		return nil, err
+	}
+	if count >= config.Search.Saved.MaxPerProfile {
+		return nil, ErrTooManySavedSearches
+	}
+
+	ss := &SavedSearch{
+		Id:       randomString(12),
+		Pid:      pid,
+		Query:    query,
+		Type:     stype,
+		Delivery: delivery,
+		Created:  time.Now().Unix(),
+	}
+
+	data, err := json.Marshal(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("SET", savedSearchKey(ss.Id), data)
+	conn.Send("SADD", profileSavedSearchesKey(pid), ss.Id)
+	conn.Send("ZADD", savedSearchScheduleKey(), time.Now().Unix(), ss.Id)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return nil, err
+	}
+
+	return ss, nil
+}
+
+func savedSearch(conn redis.Conn, id string) (*SavedSearch, error) {
+	data, err := redis.Bytes(conn.Do("GET", savedSearchKey(id)))
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &SavedSearch{}
+	if err := json.Unmarshal(data, ss); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// SavedSearches lists the searches saved by a profile
+func SavedSearches(pid datastore.PidType) ([]*SavedSearch, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("SMEMBERS", profileSavedSearchesKey(pid)))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*SavedSearch, 0, len(ids))
+	for _, id := range ids {
+		ss, err := savedSearch(conn, id)
+		if err != nil {
+			if err == redis.ErrNil {
+				continue
+			}
+			return nil, err
+		}
+		list = append(list, ss)
+	}
+	return list, nil
+}
+
+// RemoveSavedSearch deletes a search saved by a profile
+func RemoveSavedSearch(pid datastore.PidType, id string) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	isMember, err := redis.Bool(conn.Do("SISMEMBER", profileSavedSearchesKey(pid), id))
+	if err != nil {
+		return err
+	}
+	if !isMember {
+		return fmt.Errorf("Saved search %s not found", id)
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", savedSearchKey(id), savedSearchSeenKey(id))
+	conn.Send("SREM", profileSavedSearchesKey(pid), id)
+	conn.Send("ZREM", savedSearchScheduleKey(), id)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// Notifications returns a profile's most recent notifications
+func Notifications(pid datastore.PidType, start int, count int) ([]*Notification, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("LRANGE", notificationsKey(pid), start, start+count-1))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Notification, 0, len(values))
+	for _, v := range values {
+		n := &Notification{}
+		if err := json.Unmarshal([]byte(v), n); err != nil {
+			continue
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+func ClearNotifications(pid datastore.PidType) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", notificationsKey(pid))
+	return err
+}
+
+// clearSavedSearches removes every saved search and notification
+func clearSavedSearches() error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	for _, pattern := range []string{redisKey("savedsearch*"), redisKey("notifications", "*")} {
+		keys, err := redis.Strings(conn.Do("KEYS", pattern))
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if _, err := conn.Do("DEL", key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startSavedSearchScheduler checks for saved searches that are due to run
+// once a minute
+func startSavedSearchScheduler() {
+	go func() {
+		for _ = range time.Tick(time.Minute) {
+			if err := runDueSavedSearches(); err != nil {
+				applog.Errorf("Could not run saved searches: %s", err.Error())
+			}
+		}
+	}()
+}
+
+func runDueSavedSearches() error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	now := time.Now().Unix()
+	ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", savedSearchScheduleKey(), "-inf", now))
+	if err != nil {
+		return err
+	}
+
+	next := now + int64(config.Search.Saved.Interval)
+	for _, id := range ids {
+		// Only the server process that removes the search from the schedule runs it
+		claimed, err := redis.Int(conn.Do("ZREM", savedSearchScheduleKey(), id))
+		if err != nil {
+			return err
+		}
+		if claimed == 0 {
+			continue
+		}
+
+		ss, err := savedSearch(conn, id)
+		if err != nil {
+			if err == redis.ErrNil {
+				continue
+			}
+			return err
+		}
+
+		if _, err := conn.Do("ZADD", savedSearchScheduleKey(), next, id); err != nil {
+			return err
+		}
+
+		if err := runSavedSearch(conn, ss); err != nil {
+			applog.Errorf("Could not run saved search %s for %s: %s", ss.Id, ss.Pid, err.Error())
+		}
+	}
+	return nil
+}
+
+// runSavedSearch searches again and delivers any results not seen before
+func runSavedSearch(conn redis.Conn, ss *SavedSearch) error {
+	q := ParseSearchQuery(ss.Query)
+	q.Radius = config.Search.Radius
+
+	if err := ResolveLocation(context.Background(), SearchClient(), q.Location); err != nil {
+		return err
+	}
+
+	result := MediaSearch(context.Background(), q, searchMediaTypes[ss.Type], ss.Pid, nil)
+	items, _ := result.Results.(ItemSearchResults)
+
+	firstRun := ss.LastRun == 0
+	answered := true
+	for _, p := range result.Providers {
+		if p.Status != SearchStatusOk {
+			answered = false
+		}
+	}
+
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	now := time.Now().Unix()
+	delivered := 0
+	for _, item := range items {
+		if firstRun {
+			if _, err := conn.Do("ZADD", savedSearchSeenKey(ss.Id), now, item.Id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		sent, err := deliverSavedSearchResult(conn, s, ss, item, now)
+		if err != nil {
+			applog.Errorf("Could not deliver item %s for saved search %s: %s", item.Id, ss.Id, err.Error())
+			continue
+		}
+		if sent {
+			delivered++
+		}
+	}
+
+	if delivered > 0 {
+		applog.Infof("Delivered %d new results for saved search %s to %s", delivered, ss.Id, ss.Pid)
+	}
+
+	// Forget results the search has not returned for a long time
+	conn.Send("MULTI")
+	conn.Send("ZREMRANGEBYSCORE", savedSearchSeenKey(ss.Id), "-inf", now-savedSearchSeenRetention)
+	conn.Send("ZREMRANGEBYRANK", savedSearchSeenKey(ss.Id), 0, -maxSavedSearchSeen-1)
+	conn.Send("EXPIRE", savedSearchSeenKey(ss.Id), savedSearchSeenRetention)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
+	}
+
+	if firstRun && !answered {
+		return nil
+	}
+
+	ss.LastRun = now
+	data, err := json.Marshal(ss)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("SET", savedSearchKey(ss.Id), data, "XX")
+	return err
+}
+
+// deliverSavedSearchResult delivers an item that the saved search has not
+// seen before, reporting whether it was delivered. Items already seen only
+// have the time they were last seen updated. Recording an item as seen is
+// watched so that overlapping runs cannot both deliver it.
+func deliverSavedSearchResult(conn redis.Conn, s *datastore.RedisStore, ss *SavedSearch, item *datastore.Item, now int64) (bool, error) {
+	seenKey := savedSearchSeenKey(ss.Id)
+
+	if _, err := conn.Do("WATCH", seenKey); err != nil {
+		return false, err
+	}
+
+	_, err := redis.Float64(conn.Do("ZSCORE", seenKey, item.Id))
+	if err != redis.ErrNil {
+		conn.Do("UNWATCH")
+		if err != nil {
+			return false, err
+		}
+		_, err := conn.Do("ZADD", seenKey, now, item.Id)
+		return false, err
+	}
+
+	if ss.Delivery == DeliverNotify {
+		data, err := json.Marshal(&Notification{SearchId: ss.Id, Query: ss.Query, Item: item, Ts: now})
+		if err != nil {
+			conn.Do("UNWATCH")
+			return false, err
+		}
+
+		conn.Send("MULTI")
+		conn.Send("ZADD", seenKey, now, item.Id)
+		conn.Send("LPUSH", notificationsKey(ss.Pid), data)
+		conn.Send("LTRIM", notificationsKey(ss.Pid), 0, config.Search.Saved.MaxNotifications-1)
+		return execSavedSearchDelivery(conn)
+	}
+
+	// Timeline items are added to the datastore outside the transaction, so
+	// the item is recorded as seen first and forgotten again if adding fails.
+	// The item keeps the provider's id and pid and is promoted to the
+	// profile's timeline just as if the profile had promoted it.
+	conn.Send("MULTI")
+	conn.Send("ZADD", seenKey, now, item.Id)
+	if sent, err := execSavedSearchDelivery(conn); !sent {
+		return false, err
+	}
+
+	if err := saveItem(s, item, 0); err != nil {
+		conn.Do("ZREM", seenKey, item.Id)
+		return false, err
+	}
+
+	if err := s.Promote(ss.Pid, item.Id); err != nil {
+		conn.Do("ZREM", seenKey, item.Id)
+		return false, err
+	}
+	return true, nil
+}
+
+// execSavedSearchDelivery runs a delivery transaction, reporting false
+// without an error if another run recorded the item first
+func execSavedSearchDelivery(conn redis.Conn) (bool, error) {
+	if _, err := redis.Values(conn.Do("EXEC")); err != nil {
+		if err == redis.ErrNil {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
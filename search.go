@@ -2,24 +2,52 @@ package main
 
 import (
 	"cgl.tideland.biz/applog"
+	"context"
 	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"github.com/iand/eventful"
-	"github.com/iand/lastfm"
-	"github.com/iand/spotify"
-	"github.com/iand/youtube"
 	"github.com/placetime/datastore"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
-	"os"
-	"path"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Number of results requested from each provider per page of search results
+const searchPageSize = 16
+
+// Number of tracks in each page of spotify search results
+const spotifyPageSize = 100
+
+// Most profiles returned by a single profile search
+const maxProfileSearchCount = 100
+
 type SearchResults struct {
-	Results interface{} `json:"results"`
+	Results   interface{}            `json:"results"`
+	Providers []SearchProviderStatus `json:"providers,omitempty"`
+	Cursor    string                 `json:"cursor,omitempty"`
+	More      bool                   `json:"more"`
+	Total     int                    `json:"total"`
+}
+
+const (
+	SearchStatusOk          = "ok"
+	SearchStatusTimeout     = "timeout"
+	SearchStatusError       = "error"
+	SearchStatusUnavailable = "unavailable"
+)
+
+// SearchProviderStatus reports how a single provider fared in a search
+type SearchProviderStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Count  int    `json:"count"`
 }
 
 type ProfileSearchResults []*datastore.Profile
@@ -27,151 +55,514 @@ type ProfileSearchResults []*datastore.Profile
 type ItemSearchResults []*datastore.Item
 type FormattedItemSearchResults []*datastore.FormattedItem
 
-type SearchFunc func(srch string) ItemSearchResults
+// SearchQuery is a search to be made against a single provider
+type SearchQuery struct {
+	// Words to search for, excluding phrases and operators
+	Text string
+
+	Phrases []string
+	Exclude []string
+	Media   string
+	Pid     datastore.PidType
+
+	// Number of the provider's results that have already been returned
+	Offset int
+
+	// Restrictions honoured by event providers. Location is nil and the
+	// times are zero when unrestricted.
+	Location *SearchLocation
+	Radius   int // kilometres
+	From     time.Time
+	To       time.Time
+}
 
-func ProfileSearch(srch string) SearchResults {
-	s := datastore.NewRedisStore()
-	defer s.Close()
+// SearchLocation is a place to search for events near, given by name, by
+// coordinates or both
+type SearchLocation struct {
+	Name      string
+	Latitude  float64
+	Longitude float64
+}
+
+func (l *SearchLocation) HasCoordinates() bool {
+	return l.Latitude != 0 || l.Longitude != 0
+}
+
+// String returns the location in a form understood by most providers
+func (l *SearchLocation) String() string {
+	if l.HasCoordinates() {
+		return fmt.Sprintf("%f,%f", l.Latitude, l.Longitude)
+	}
+	return l.Name
+}
+
+// Coordinates of places looked up by name, keyed by lower case name
+var placeCache = NewCache(24*time.Hour, 0)
+
+// ResolveLocation fills in the coordinates of a location given only by name
+// so that every provider can restrict its results to the area. It returns an
+// error if the place cannot be found. When places cannot be looked up the
+// location is left as a name, which only providers that take place names use.
+func ResolveLocation(ctx context.Context, client *http.Client, l *SearchLocation) error {
+	if l == nil || l.HasCoordinates() {
+		return nil
+	}
 
-	plist, _ := s.FindProfilesBySubstring(srch)
+	key := strings.ToLower(strings.TrimSpace(l.Name))
+	if value, found, _ := placeCache.Get(key); found {
+		coords := value.(SearchLocation)
+		l.Latitude, l.Longitude = coords.Latitude, coords.Longitude
+		return nil
+	}
 
-	return SearchResults{Results: plist}
+	c := config.Search.Songkick
+	if !c.Enabled || c.AppKey == "" {
+		return nil
+	}
+
+	results, err := songkickSearchLocations(ctx, client, c.AppKey, key)
+	if err != nil {
+		applog.Errorf("Lookup of location %s got error %s", l.Name, err.Error())
+		return nil
+	}
+
+	for _, place := range results.ResultsPage.Results.Locations {
+		for _, area := range []SongkickArea{place.City, place.MetroArea} {
+			if area.Lat != 0 || area.Lng != 0 {
+				l.Latitude, l.Longitude = area.Lat, area.Lng
+				placeCache.Set(key, SearchLocation{Latitude: area.Lat, Longitude: area.Lng})
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Could not find a place called %s", l.Name)
 }
 
-func ItemSearch(srch string, pid datastore.PidType) SearchResults {
-	searches := []SearchFunc{
-		searchYoutubeVidoes,
-		searchEventfulEvents,
-		searchSpotifyTracks,
+// DateRange returns the time range of the query, filling in any missing end
+// so that the range runs from now until a year after it starts
+func (q SearchQuery) DateRange() (time.Time, time.Time) {
+	from, to := q.From, q.To
+	if from.IsZero() {
+		from = time.Now()
+	}
+	if to.IsZero() {
+		to = from.AddDate(1, 0, 0)
 	}
+	return from, to
+}
 
-	return MultiplexedSearch(srch, searches)
+func (q SearchQuery) HasDateRange() bool {
+	return !q.From.IsZero() || !q.To.IsZero()
 }
 
-func VideoSearch(srch string, pid datastore.PidType) SearchResults {
+// Within reports whether an event at the given coordinates and time meets
+// the location and date restrictions of the query. It is used to filter the
+// results of providers that cannot apply the restrictions themselves.
+func (q SearchQuery) Within(lat float64, lng float64, t time.Time) bool {
+	if q.HasDateRange() {
+		from, to := q.DateRange()
+		if t.Before(from) || t.After(to) {
+			return false
+		}
+	}
+
+	if q.Location != nil && q.Location.HasCoordinates() && q.Radius > 0 && (lat != 0 || lng != 0) {
+		if distanceKm(q.Location.Latitude, q.Location.Longitude, lat, lng) > float64(q.Radius) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// distanceKm returns the great circle distance between two points
+func distanceKm(lat1 float64, lng1 float64, lat2 float64, lng2 float64) float64 {
+	const earthRadiusKm = 6371
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlng := (lng2 - lng1) * rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlng/2)*math.Sin(dlng/2)
+	return 2 * earthRadiusKm * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// SearchPage is one page of results from a single provider
+type SearchPage struct {
+	Items ItemSearchResults
+
+	// Offset of the provider's next page of results, zero if there are no
+	// more results
+	Next int
+}
+
+// SearchFunc searches a provider, making any requests with client
+type SearchFunc func(ctx context.Context, client *http.Client, q SearchQuery) (*SearchPage, error)
+
+// SearchCursor records the offset of the next page of results for each
+// provider. Providers that have no more results are omitted.
+type SearchCursor map[string]int
+
+// Encode returns the cursor in the opaque form given to clients
+func (c SearchCursor) Encode() string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+// DecodeSearchCursor parses a cursor given by a client, rejecting offsets
+// that are negative or belong to none of the given providers
+func DecodeSearchCursor(s string, providers []SearchProvider) (SearchCursor, error) {
+	data, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid search cursor")
+	}
+
+	c := make(SearchCursor)
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("Invalid search cursor")
+	}
+
+	known := make(map[string]bool, len(providers))
+	for _, p := range providers {
+		known[p.Name()] = true
+	}
+	for name, offset := range c {
+		if !known[name] || offset < 0 {
+			return nil, fmt.Errorf("Invalid search cursor")
+		}
+	}
+	return c, nil
+}
+
+// PageSearchCursor returns a cursor positioned at the given page of results
+// for each of the providers
+func PageSearchCursor(page int, providers []SearchProvider) SearchCursor {
+	c := make(SearchCursor, len(providers))
+	for _, p := range providers {
+		c[p.Name()] = (page - 1) * searchPageSize
+	}
+	return c
+}
+
+// Values of ProfileFilter.FeedType matching any feed or only people
+const (
+	ProfileFeedTypeAny    = "feed"
+	ProfileFeedTypePerson = "person"
+)
+
+// ProfileFilter restricts the profiles found by a profile search. Empty
+// fields are not restricted.
+type ProfileFilter struct {
+	// ProfileFeedTypeAny, ProfileFeedTypePerson or a feed type such as
+	// datastore.FeedTypeRss
+	FeedType string
+
+	ItemType  string
+	Location  string // matched anywhere in the profile's location, ignoring case
+	ParentPid datastore.PidType
+}
+
+func (f ProfileFilter) IsEmpty() bool {
+	return f == ProfileFilter{}
+}
+
+func (f ProfileFilter) Matches(p *datastore.Profile) bool {
+	switch f.FeedType {
+	case "":
+	case ProfileFeedTypeAny:
+		if p.FeedType == "" {
+			return false
+		}
+	case ProfileFeedTypePerson:
+		if p.FeedType != "" {
+			return false
+		}
+	default:
+		if p.FeedType != f.FeedType {
+			return false
+		}
+	}
+
+	if f.ItemType != "" && p.ItemType != f.ItemType {
+		return false
+	}
 
-	searches := []SearchFunc{
-		searchYoutubeVidoes,
+	if f.ParentPid != "" && p.ParentPid != f.ParentPid {
+		return false
 	}
 
-	return MultiplexedSearch(srch, searches)
+	if f.Location != "" && !strings.Contains(strings.ToLower(p.Location), strings.ToLower(f.Location)) {
+		return false
+	}
+
+	return true
 }
 
-func AudioSearch(srch string, pid datastore.PidType) SearchResults {
+// ProfileSearch returns count of the profiles containing srch that match the
+// filter, ordered by pid and starting with the profile at start. The total
+// number of matching profiles is included in the results.
+func ProfileSearch(srch string, filter ProfileFilter, start int, count int) (SearchResults, error) {
+	s := datastore.NewRedisStore()
+	defer s.Close()
+
+	plist, err := s.FindProfilesBySubstring(srch)
+	if err != nil {
+		return SearchResults{}, err
+	}
 
-	searches := []SearchFunc{
-		searchSpotifyTracks,
+	matches := make(ProfileSearchResults, 0, len(plist))
+	for _, p := range plist {
+		if filter.Matches(p) {
+			matches = append(matches, p)
+		}
 	}
 
-	return MultiplexedSearch(srch, searches)
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Pid < matches[j].Pid })
+
+	results := SearchResults{Results: ProfileSearchResults{}, Total: len(matches)}
+	if start < len(matches) {
+		end := len(matches)
+		if count < end-start {
+			end = start + count
+			results.More = true
+		}
+		results.Results = matches[start:end]
+	}
+	return results, nil
+}
+
+func ItemSearch(ctx context.Context, q SearchQuery, pid datastore.PidType, cursor SearchCursor) SearchResults {
+	return MediaSearch(ctx, q, "", pid, cursor)
 }
 
-func EventSearch(srch string, pid datastore.PidType) SearchResults {
+func VideoSearch(ctx context.Context, q SearchQuery, pid datastore.PidType, cursor SearchCursor) SearchResults {
+	return MediaSearch(ctx, q, "video", pid, cursor)
+}
+
+func AudioSearch(ctx context.Context, q SearchQuery, pid datastore.PidType, cursor SearchCursor) SearchResults {
+	return MediaSearch(ctx, q, "audio", pid, cursor)
+}
+
+func EventSearch(ctx context.Context, q SearchQuery, pid datastore.PidType, cursor SearchCursor) SearchResults {
+	return MediaSearch(ctx, q, "event", pid, cursor)
+}
 
-	searches := []SearchFunc{
-		searchEventfulEvents,
+// MediaSearch searches every enabled provider that returns the given media
+// type, or all enabled providers if media is empty. A nil cursor fetches the
+// first page of results.
+func MediaSearch(ctx context.Context, q SearchQuery, media string, pid datastore.PidType, cursor SearchCursor) SearchResults {
+	if q.Media != "" {
+		media = q.Media
+	}
+
+	// Providers of several media types only return the media searched for
+	q.Media = media
+
+	providers := make([]SearchProvider, 0)
+	for _, p := range SearchProviders(media) {
+		// Items from external providers belong to the provider's profile
+		if q.Pid != "" && datastore.PidType(p.Name()) != q.Pid {
+			continue
+		}
+		providers = append(providers, CachedSearchProvider(HealthSearchProvider(p), media))
 	}
 
-	return MultiplexedSearch(srch, searches)
+	return MultiplexedSearch(ctx, q, providers, cursor)
 }
 
-func MultiplexedSearch(srch string, searches []SearchFunc) SearchResults {
-	results := make(ItemSearchResults, 0)
+// MultiplexedSearch runs the search against each provider concurrently and
+// ranks their combined results. Providers that have not answered by the
+// configured search timeout are cancelled and reported as timed out.
+func MultiplexedSearch(ctx context.Context, query SearchQuery, providers []SearchProvider, cursor SearchCursor) SearchResults {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Search.Timeout)*time.Millisecond)
+	defer cancel()
+
+	if cursor != nil {
+		// Skip providers that have no more results
+		remaining := make([]SearchProvider, 0, len(providers))
+		for _, p := range providers {
+			if _, exists := cursor[p.Name()]; exists {
+				remaining = append(remaining, p)
+			}
+		}
+		providers = remaining
+	}
+
+	type providerResult struct {
+		index int
+		page  *SearchPage
+		err   error
+	}
 
-	items := make(chan ItemSearchResults)
+	// Buffered so that providers finishing after the timeout never block
+	responses := make(chan providerResult, len(providers))
 
-	for _, f := range searches {
-		go func() { items <- f(srch) }()
+	statuses := make([]SearchProviderStatus, len(providers))
+	for i, p := range providers {
+		statuses[i] = SearchProviderStatus{Name: p.Name(), Status: SearchStatusTimeout}
+
+		q := query
+		q.Offset = cursor[p.Name()]
+		if q.Offset < 0 {
+			q.Offset = 0
+		}
+		go func(index int, p SearchProvider) {
+			page, err := p.Search(ctx, q)
+			responses <- providerResult{index: index, page: page, err: err}
+		}(i, p)
 	}
 
-	lists := make([]ItemSearchResults, 0)
+	lists := make([]ItemSearchResults, len(providers))
+	next := make(SearchCursor)
+	more := false
 
-	timeout := time.After(time.Duration(config.Search.Timeout) * time.Millisecond)
-	for i := 0; i < len(searches); i++ {
+	remaining := len(providers)
+wait:
+	for remaining > 0 {
 		select {
-		case result := <-items:
-			lists = append(lists, result)
-		case <-timeout:
-			applog.Debugf("Search timed out")
-			break
-		}
-	}
-
-	i := 0
-	added := true
-	for added {
-		added = false
-		for _, list := range lists {
-			if i < len(list) {
-				results = append(results, list[i])
-				added = true
+		case r := <-responses:
+			remaining--
+			if r.err != nil {
+				if r.err == ErrProviderUnavailable {
+					statuses[r.index].Status = SearchStatusUnavailable
+				} else if ctx.Err() == nil {
+					statuses[r.index].Status = SearchStatusError
+				}
+				continue
+			}
+			lists[r.index] = filterItems(r.page.Items, query)
+			statuses[r.index].Status = SearchStatusOk
+			statuses[r.index].Count = len(lists[r.index])
+			if r.page.Next > 0 {
+				next[providers[r.index].Name()] = r.page.Next
+				more = true
 			}
+		case <-ctx.Done():
+			applog.Debugf("Search for %s timed out waiting for %d providers", query, remaining)
+			break wait
 		}
-		i++
 	}
 
-	return SearchResults{Results: results}
+	// Providers that timed out or failed while paging are asked for the same
+	// page again next time rather than being dropped from the cursor. They
+	// only ride along with providers that have more results, so a provider
+	// that is down cannot keep the client loading more forever.
+	if cursor != nil {
+		for i, p := range providers {
+			if statuses[i].Status != SearchStatusOk {
+				next[p.Name()] = cursor[p.Name()]
+			}
+		}
+	}
+
+	names := make([]string, len(providers))
+	for i, p := range providers {
+		names[i] = p.Name()
+	}
+
+	results := SearchResults{
+		Results:   RankSearchResults(query.PlainText(), lists, names),
+		Providers: statuses,
+	}
+
+	if more {
+		results.Cursor = next.Encode()
+		results.More = true
+	}
+
+	return results
 
 }
 
-func searchYoutubeVidoes(srch string) ItemSearchResults {
+func searchYoutubeVidoes(ctx context.Context, client *http.Client, q SearchQuery) (*SearchPage, error) {
 	items := make([]*datastore.Item, 0)
 
-	c := youtube.New()
-
-	feed, err := c.VideoSearch(srch)
+	feed, err := youtubeVideoSearch(ctx, client, q.KeywordsWithExclusions(), q.Offset+1, searchPageSize)
 	if err != nil {
 		applog.Errorf("Fetch of feed got http error  %s", err.Error())
-		return items
+		return nil, err
 	}
 
-	if feed != nil {
-		for _, item := range feed.Entries {
-			hasher := md5.New()
-			io.WriteString(hasher, item.ID.Value)
-			id := datastore.ItemIdType(fmt.Sprintf("%x", hasher.Sum(nil)))
+	for _, item := range feed.Entries {
+		hasher := md5.New()
+		io.WriteString(hasher, item.ID.String())
+		id := datastore.ItemIdType(fmt.Sprintf("%x", hasher.Sum(nil)))
 
-			var url string
-			for _, link := range item.Links {
-				if link.Rel == "self" {
-					url = link.Href
-					break
-				}
+		var url string
+		for _, link := range item.Links {
+			if link.Rel == "self" {
+				url = link.Href
+				break
 			}
+		}
 
-			bestImage, bestImageName := "", ""
+		duration, _ := strconv.Atoi(item.Media.Duration.Seconds)
 
-			for _, img := range item.Media.Thumbnails {
-				if img.Name == "sddefault" ||
-					(img.Name == "hqdefault" && bestImageName != "sddefault") ||
-					(img.Name == "mqdefault" && bestImageName != "sddefault" && bestImageName != "hqdefault") ||
-					(img.Name == "default " && bestImageName != "mqdefault" && bestImageName != "sddefault" && bestImageName != "hqdefault") {
-					bestImage = img.URL
-					bestImageName = img.Name
+		items = append(items, &datastore.Item{Id: id, Pid: datastore.PidType(config.Search.Youtube.Pid), Event: 0, Text: item.Title.String(), Link: url, Media: "video", Image: bestYoutubeThumbnail(item.Media.Thumbnails), Duration: duration})
+	}
 
-				}
-			}
+	page := &SearchPage{Items: items}
+	if feed.More() {
+		page.Next = q.Offset + len(feed.Entries)
+	}
+	return page, nil
+
+}
 
-			items = append(items, &datastore.Item{Id: id, Pid: datastore.PidType(config.Search.Youtube.Pid), Event: 0, Text: item.Title.Value, Link: url, Media: "video", Image: bestImage, Duration: item.Media.Duration.Seconds})
+// Youtube thumbnail names in order of preference
+var youtubeThumbnailRank = map[string]int{
+	"sddefault": 4,
+	"hqdefault": 3,
+	"mqdefault": 2,
+	"default":   1,
+}
+
+// bestYoutubeThumbnail returns the URL of the preferred thumbnail, if any
+func bestYoutubeThumbnail(thumbnails []YoutubeThumbnail) string {
+	best, bestRank := "", 0
+	for _, img := range thumbnails {
+		if rank := youtubeThumbnailRank[img.Name]; rank > bestRank {
+			best, bestRank = img.URL, rank
 		}
 	}
-	return items
-
+	return best
 }
 
-func searchEventfulEvents(srch string) ItemSearchResults {
+func searchEventfulEvents(ctx context.Context, client *http.Client, q SearchQuery) (*SearchPage, error) {
 	items := make([]*datastore.Item, 0)
 
-	c := eventful.New(config.Search.Eventful.AppKey)
+	params := EventfulSearchParams{
+		Keywords:   q.Keywords(),
+		Date:       "Future",
+		PageSize:   searchPageSize,
+		PageNumber: q.Offset/searchPageSize + 1,
+	}
 
-	results, err := c.SearchEvents(srch, "Future")
+	if q.HasDateRange() {
+		from, to := q.DateRange()
+		params.Date = fmt.Sprintf("%s00-%s00", from.Format("20060102"), to.Format("20060102"))
+	}
+
+	if q.Location != nil {
+		params.Location = q.Location.String()
+		params.Within = q.Radius
+	}
+
+	results, err := eventfulSearchEvents(ctx, client, config.Search.Eventful.AppKey, params)
 	if err != nil {
 		applog.Errorf("Fetch of events got error  %s", err.Error())
-		return items
+		return nil, err
 	}
 
-	applog.Debugf("Received %d items from eventful matching %s", len(results.Events), srch)
-	for _, event := range results.Events {
+	events, err := results.List()
+	if err != nil {
+		applog.Errorf("Parse of events got error  %s", err.Error())
+		return nil, err
+	}
+
+	applog.Debugf("Received %d items from eventful matching %s", len(events), q)
+	for _, event := range events {
 		hasher := md5.New()
 		io.WriteString(hasher, event.ID)
 		id := datastore.ItemIdType(fmt.Sprintf("%x", hasher.Sum(nil)))
@@ -181,39 +572,143 @@ func searchEventfulEvents(srch string) ItemSearchResults {
 			imgURL = event.Image.Medium.URL
 		}
 
+		startTime, duration := eventfulEventTimes(event)
+
+		items = append(items, &datastore.Item{Id: id, Pid: datastore.PidType(config.Search.Eventful.Pid), Event: datastore.FakeEventPrecision(startTime), Text: event.Title, Link: event.URL, Media: "event", Image: imgURL, Duration: duration})
+	}
+
+	page := &SearchPage{Items: items}
+	if results.More() {
+		page.Next = params.PageNumber * searchPageSize
+	}
+	return page, nil
+
+}
+
+// eventfulEventTimes returns the start of an event and its duration in
+// seconds. Events without a start time start at the unix epoch and the
+// duration is zero unless a stop time after the start is given.
+func eventfulEventTimes(event EventfulEvent) (time.Time, int) {
+	startTime, err := time.Parse("2006-01-02 15:04:05", event.StartTime)
+	if err != nil {
+		return time.Unix(0, 0), 0
+	}
+
+	stopTime, err := time.Parse("2006-01-02 15:04:05", event.StopTime)
+	if err != nil || !stopTime.After(startTime) {
+		return startTime, 0
+	}
+	return startTime, int(stopTime.Sub(startTime).Seconds())
+}
+
+func searchSongkickEvents(ctx context.Context, client *http.Client, q SearchQuery) (*SearchPage, error) {
+	items := make([]*datastore.Item, 0)
+
+	pageNumber := q.Offset/searchPageSize + 1
+
+	params := SongkickSearchParams{
+		ArtistName: q.PlainText(),
+		Page:       pageNumber,
+		PerPage:    searchPageSize,
+	}
+
+	// Songkick finds events by metro area so the radius is applied afterwards
+	if q.Location != nil && q.Location.HasCoordinates() {
+		params.Location = fmt.Sprintf("geo:%f,%f", q.Location.Latitude, q.Location.Longitude)
+	}
+
+	if q.HasDateRange() {
+		params.MinDate, params.MaxDate = q.DateRange()
+	}
+
+	results, err := songkickSearchEvents(ctx, client, config.Search.Songkick.AppKey, params)
+	if err != nil {
+		applog.Errorf("Fetch of songkick events got error  %s", err.Error())
+		return nil, err
+	}
+
+	applog.Debugf("Received %d items from songkick matching %s", len(results.ResultsPage.Results.Events), q)
+	for _, event := range results.ResultsPage.Results.Events {
+		if event.Status == "cancelled" {
+			continue
+		}
+
+		hasher := md5.New()
+		io.WriteString(hasher, event.URI)
+		id := datastore.ItemIdType(fmt.Sprintf("%x", hasher.Sum(nil)))
+
+		imgURL := ""
+		if headliner := event.Headliner(); headliner != nil {
+			imgURL = headliner.ImageURL()
+		}
+
+		text := event.DisplayName
+		if event.Venue.DisplayName != "" && !strings.Contains(text, event.Venue.DisplayName) {
+			text = fmt.Sprintf("%s / %s", text, event.Venue.DisplayName)
+		}
+
 		duration := 0
-		startTime, err := time.Parse("2006-01-02 15:04:05", event.StartTime)
+		startTime, err := parseSongkickTime(event.Start)
 		if err != nil {
 			startTime = time.Unix(0, 0)
-		} else {
-			stopTime, err := time.Parse("2006-01-02 15:04:05", event.StopTime)
-			if err == nil {
+		} else if event.End != nil {
+			stopTime, err := parseSongkickTime(*event.End)
+			if err == nil && stopTime.After(startTime) {
 				duration = int(stopTime.Sub(startTime).Seconds())
 			}
+		}
 
+		if !q.Within(event.Location.Lat, event.Location.Lng, startTime) {
+			continue
 		}
 
-		items = append(items, &datastore.Item{Id: id, Pid: datastore.PidType(config.Search.Eventful.Pid), Event: datastore.FakeEventPrecision(startTime), Text: event.Title, Link: event.URL, Media: "event", Image: imgURL, Duration: duration})
+		items = append(items, &datastore.Item{Id: id, Pid: datastore.PidType(config.Search.Songkick.Pid), Event: datastore.FakeEventPrecision(startTime), Text: text, Link: event.URI, Media: "event", Image: imgURL, Duration: duration})
+	}
+
+	page := &SearchPage{Items: items}
+	if results.ResultsPage.More() {
+		page.Next = pageNumber * searchPageSize
 	}
-	return items
+	return page, nil
 
 }
 
-func searchSpotifyTracks(srch string) ItemSearchResults {
+// Songkick only supplies a datetime when the start time of the event is known
+func parseSongkickTime(t SongkickTime) (time.Time, error) {
+	if t.DateTime != "" {
+		return time.Parse("2006-01-02T15:04:05-0700", t.DateTime)
+	}
+	return time.Parse("2006-01-02", t.Date)
+}
+
+func searchSpotifyTracks(ctx context.Context, client *http.Client, q SearchQuery) (*SearchPage, error) {
 	items := make([]*datastore.Item, 0)
 
-	client := spotify.New()
-	resp, err := client.SearchTracks(srch, 1)
+	// Spotify pages are much larger than ours so start part way through one
+	pageNumber := q.Offset/spotifyPageSize + 1
+	skip := q.Offset % spotifyPageSize
+
+	resp, err := spotifySearchTracks(ctx, client, q.Keywords(), pageNumber)
 
 	if err != nil {
 		applog.Errorf("Fetch of spotify search got http error  %s", err.Error())
-		return items
+		return nil, err
 	}
 
-	count := 0
+	page := &SearchPage{}
 	if resp != nil {
-		applog.Debugf("Received %d items from spotify matching %s", len(resp.Tracks), srch)
-		for _, track := range resp.Tracks {
+		applog.Debugf("Received %d items from spotify matching %s", len(resp.Tracks), q)
+		for i := skip; i < len(resp.Tracks); i++ {
+			if len(items) == searchPageSize {
+				page.Next = (pageNumber-1)*spotifyPageSize + i
+				break
+			}
+
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			track := resp.Tracks[i]
 			if len(track.Artists) > 0 {
 				hasher := md5.New()
 				io.WriteString(hasher, track.URI)
@@ -221,8 +716,9 @@ func searchSpotifyTracks(srch string) ItemSearchResults {
 
 				artist := track.Artists[0].Name
 
-				var imgPath string
-				imgPath = fetchTrackImage(track.URI)
+				// Tracks without an image are looked up on last.fm when
+				// their images are mirrored
+				imgPath := fetchTrackImage(ctx, client, track.URI)
 
 				text := fmt.Sprintf("%s / %s", track.Name, artist)
 
@@ -236,34 +732,186 @@ func searchSpotifyTracks(srch string) ItemSearchResults {
 					Image:    imgPath,
 					Duration: int(track.Length),
 				})
+			}
+		}
 
-				count++
-				if count > 15 {
-					break
-				}
+		// A full page suggests that spotify has more tracks to give
+		if page.Next == 0 && len(resp.Tracks) == spotifyPageSize {
+			page.Next = pageNumber * spotifyPageSize
+		}
+	}
+
+	page.Items = items
+	return page, nil
+
+}
+
+// searchLastfm finds tracks and the upcoming events of the artist searched
+// for, or only one of them when the search is restricted to audio or events
+func searchLastfm(ctx context.Context, client *http.Client, q SearchQuery) (*SearchPage, error) {
+	switch q.Media {
+	case "audio":
+		return searchLastfmTracks(ctx, client, q)
+	case "event":
+		return searchLastfmEvents(ctx, client, q)
+	}
+
+	tracks, err := searchLastfmTracks(ctx, client, q)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := searchLastfmEvents(ctx, client, q)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both searches page through results in the same steps
+	page := &SearchPage{Items: append(tracks.Items, events.Items...), Next: tracks.Next}
+	if events.Next > page.Next {
+		page.Next = events.Next
+	}
+	return page, nil
+}
+
+func searchLastfmTracks(ctx context.Context, client *http.Client, q SearchQuery) (*SearchPage, error) {
+	items := make([]*datastore.Item, 0)
+
+	pageNumber := q.Offset/searchPageSize + 1
+
+	results, err := lastfmSearchTracks(ctx, client, config.Search.Lastfm.APIKey, q.PlainText(), pageNumber, searchPageSize)
+	if err != nil {
+		applog.Errorf("Fetch of last.fm tracks got error  %s", err.Error())
+		return nil, err
+	}
+
+	page := &SearchPage{}
+	if results.Results != nil {
+		tracks, err := results.Results.List()
+		if err != nil {
+			return nil, err
+		}
+
+		applog.Debugf("Received %d tracks from last.fm matching %s", len(tracks), q)
+		for _, track := range tracks {
+			hasher := md5.New()
+			io.WriteString(hasher, track.URL)
+			id := datastore.ItemIdType(fmt.Sprintf("%x", hasher.Sum(nil)))
+
+			text := track.Name
+			if track.Artist != "" {
+				text = fmt.Sprintf("%s / %s", track.Name, track.Artist)
 			}
+
+			items = append(items, &datastore.Item{Id: id, Pid: datastore.PidType(config.Search.Lastfm.Pid), Text: text, Link: track.URL, Media: "audio", Image: track.Image.Largest()})
+		}
+
+		if results.Results.More() {
+			page.Next = pageNumber * searchPageSize
+		}
+	}
+
+	page.Items = items
+	return page, nil
+}
+
+func searchLastfmEvents(ctx context.Context, client *http.Client, q SearchQuery) (*SearchPage, error) {
+	items := make([]*datastore.Item, 0)
+
+	pageNumber := q.Offset/searchPageSize + 1
+
+	results, err := lastfmArtistEvents(ctx, client, config.Search.Lastfm.APIKey, q.PlainText(), pageNumber, searchPageSize)
+	if err != nil {
+		// The search is not the name of an artist last.fm knows
+		if lerr, ok := err.(*LastfmError); ok && lerr.Code == lastfmErrorInvalidParameters {
+			return &SearchPage{Items: items}, nil
+		}
+		applog.Errorf("Fetch of last.fm events got error  %s", err.Error())
+		return nil, err
+	}
+
+	events, err := results.List()
+	if err != nil {
+		return nil, err
+	}
+
+	applog.Debugf("Received %d events from last.fm matching %s", len(events), q)
+	for _, event := range events {
+		if event.Cancelled == "1" {
+			continue
+		}
+
+		hasher := md5.New()
+		io.WriteString(hasher, event.URL)
+		id := datastore.ItemIdType(fmt.Sprintf("%x", hasher.Sum(nil)))
+
+		text := event.Title
+		if event.Venue.Name != "" && !strings.Contains(text, event.Venue.Name) {
+			text = fmt.Sprintf("%s / %s", text, event.Venue.Name)
+		}
+
+		duration := 0
+		startTime, err := event.Start()
+		if err != nil {
+			startTime = time.Unix(0, 0)
+		} else if stopTime, err := event.End(); err == nil && stopTime.After(startTime) {
+			duration = int(stopTime.Sub(startTime).Seconds())
+		}
+
+		lat, lng := event.Venue.Coordinates()
+		if !q.Within(lat, lng, startTime) {
+			continue
 		}
+
+		items = append(items, &datastore.Item{Id: id, Pid: datastore.PidType(config.Search.Lastfm.Pid), Event: datastore.FakeEventPrecision(startTime), Text: text, Link: event.URL, Media: "event", Image: event.Image.Largest(), Duration: duration})
 	}
-	return items
 
+	page := &SearchPage{Items: items}
+	if results.More() {
+		page.Next = pageNumber * searchPageSize
+	}
+	return page, nil
 }
 
 // spotify:track:24H5KPBdSvHQMRXTp12K3J
 // http://open.spotify.com/track/24H5KPBdSvHQMRXTp12K3J
 
-func fetchTrackImage(spotifyURL string) string {
-	if len(spotifyURL) < 36 {
+// Image URLs scraped from spotify track pages, keyed by track URI
+var trackImageCache = NewCache(24*time.Hour, 0)
+
+func fetchTrackImage(ctx context.Context, client *http.Client, spotifyURL string) string {
+	if value, found, _ := trackImageCache.Get(spotifyURL); found {
+		return value.(string)
+	}
+
+	imgURL, err := fetchTrackImageFromPage(ctx, client, spotifyURL)
+	if err != nil {
 		return ""
 	}
+
+	// Tracks without images are cached too so their pages are not fetched again
+	trackImageCache.Set(spotifyURL, imgURL)
+	return imgURL
+}
+
+func fetchTrackImageFromPage(ctx context.Context, client *http.Client, spotifyURL string) (string, error) {
+	if len(spotifyURL) < 36 {
+		return "", nil
+	}
 	hash := spotifyURL[14:]
 
 	pageUrl := fmt.Sprintf("http://open.spotify.com/track/%s", hash)
 	// applog.Debugf("Fetching spotify page %s", pageUrl)
 
-	resp, err := http.Get(pageUrl)
+	req, err := http.NewRequest("GET", pageUrl, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		applog.Errorf("Fetch of spotify page %s got http error %s", pageUrl, err.Error())
-		return ""
+		return "", err
 	}
 
 	defer resp.Body.Close()
@@ -271,54 +919,29 @@ func fetchTrackImage(spotifyURL string) string {
 	content, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		applog.Errorf("Read of spotify page %s got io error %s", pageUrl, err.Error())
-		return ""
-	}
-
-	re, err := regexp.Compile(`"(http://o\.scdn\.co/300/[A-Za-z0-9]+)"`)
-	if err != nil {
-		return ""
+		return "", err
 	}
 
-	matches := re.FindAllSubmatch(content, -1)
+	matches := trackImageRegexp.FindAllSubmatch(content, -1)
 	if len(matches) > 0 {
-		return string(matches[0][1])
+		return string(matches[0][1]), nil
 	}
 
-	return ""
+	return "", nil
 }
 
-func fetchTrackImageLastfm(trackname string, artist string, itemID datastore.ItemIdType) (string, error) {
-	filename := fmt.Sprintf("%s.png", itemID)
-	foutName := path.Join(config.Image.Path, filename)
+var trackImageRegexp = regexp.MustCompile(`"(http://o\.scdn\.co/300/[A-Za-z0-9]+)"`)
 
-	if _, err := os.Stat(foutName); err == nil {
-		return filename, nil
-	}
-
-	lc := lastfm.New(config.Search.Lastfm.APIKey)
-	track, err := lc.TrackInfoByName(trackname, artist, "")
+// fetchTrackImageLastfm returns the URL of the largest album image last.fm
+// has for the track
+func fetchTrackImageLastfm(ctx context.Context, client *http.Client, trackname string, artist string) (string, error) {
+	info, err := lastfmTrackInfo(ctx, client, config.Search.Lastfm.APIKey, trackname, artist)
 	if err != nil {
 		return "", err
 	}
 
-	bestImageURL := ""
-	bestImageSize := ""
-	for _, img := range track.Album.Image {
-
-		if img.Size == "mega" {
-			bestImageURL = img.URL
-			break
-		}
-
-		if img.Size == "extralarge" ||
-			(img.Size == "large" && bestImageSize != "extralarge") ||
-			(img.Size == "medium" && bestImageSize != "extralarge" && bestImageSize != "large") ||
-			(img.Size == "small" && bestImageSize != "extralarge" && bestImageSize != "large" && bestImageSize != "medium") {
-			bestImageSize = img.Size
-			bestImageURL = img.URL
-		}
-
+	if info.Track == nil || info.Track.Album == nil {
+		return "", nil
 	}
-
-	return bestImageURL, nil
+	return info.Track.Album.Image.Largest(), nil
 }
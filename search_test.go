@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"github.com/placetime/datastore"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The provider searches are run against the responses in testdata/fixtures.
+// These are synthetic, written by hand in the shape of each provider's API
+// rather than recorded, so they only cover the fields the searches read.
+// Real responses can be recorded over them by running the server with
+// -fixtures=record and the same searches.
+
+func replayClient() *http.Client {
+	config = DefaultConfig
+	return newSearchClient(FixturesConfig{Mode: FixturesReplay, Path: "testdata/fixtures"})
+}
+
+func itemId(key string) datastore.ItemIdType {
+	hasher := md5.New()
+	io.WriteString(hasher, key)
+	return datastore.ItemIdType(fmt.Sprintf("%x", hasher.Sum(nil)))
+}
+
+func eventTime(layout string, value string) int64 {
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		panic(err)
+	}
+	return datastore.FakeEventPrecision(t)
+}
+
+func checkSearchPage(t *testing.T, name string, page *SearchPage, err error, expected []*datastore.Item, next int) {
+	if err != nil {
+		t.Fatalf("%s: got error %s", name, err)
+	}
+
+	if len(page.Items) != len(expected) {
+		t.Fatalf("%s: got %d items, wanted %d", name, len(page.Items), len(expected))
+	}
+
+	for i, item := range page.Items {
+		if !reflect.DeepEqual(item, expected[i]) {
+			t.Errorf("%s: item %d got %+v, wanted %+v", name, i, item, expected[i])
+		}
+	}
+
+	if page.Next != next {
+		t.Errorf("%s: got next %d, wanted %d", name, page.Next, next)
+	}
+}
+
+func TestSearchEventfulEvents(t *testing.T) {
+	client := replayClient()
+	pid := datastore.PidType(config.Search.Eventful.Pid)
+
+	expected := []*datastore.Item{
+		{
+			Id:       itemId("E0-001-000218163-6"),
+			Pid:      pid,
+			Event:    eventTime("2006-01-02 15:04:05", "2013-05-10 20:00:00"),
+			Text:     "Jazz at the Vortex",
+			Link:     "http://eventful.com/london/events/jazz-vortex-/E0-001-000218163-6",
+			Media:    "event",
+			Image:    "http://s1.evcdn.com/images/medium/I0-001/004/123/001-2.jpeg",
+			Duration: 12600,
+		},
+		{
+			Id:    itemId("E0-001-000218200-1"),
+			Pid:   pid,
+			Event: eventTime("2006-01-02 15:04:05", "2013-05-11 23:15:00"),
+			Text:  "Ronnie Scott's Late Late Show",
+			Link:  "http://eventful.com/london/events/ronnie-scotts-late-late-show-/E0-001-000218200-1",
+			Media: "event",
+		},
+		{
+			Id:    itemId("E0-001-000218311-9"),
+			Pid:   pid,
+			Event: datastore.FakeEventPrecision(time.Unix(0, 0)),
+			Text:  "Summer Jazz Festival",
+			Link:  "http://eventful.com/london/events/summer-jazz-festival-/E0-001-000218311-9",
+			Media: "event",
+		},
+	}
+
+	page, err := searchEventfulEvents(context.Background(), client, SearchQuery{Text: "jazz"})
+	checkSearchPage(t, "eventful", page, err, expected, searchPageSize)
+}
+
+func TestEventfulEventTimes(t *testing.T) {
+	start := time.Date(2013, 5, 10, 20, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		start    string
+		stop     string
+		time     time.Time
+		duration int
+	}{
+		{"2013-05-10 20:00:00", "2013-05-10 23:30:00", start, 12600},
+		{"2013-05-10 20:00:00", "", start, 0},
+		{"2013-05-10 20:00:00", "2013-05-10 20:00:00", start, 0},
+		{"2013-05-10 20:00:00", "2013-05-10 19:00:00", start, 0},
+		{"2013-05-10 20:00:00", "tomorrow", start, 0},
+		{"", "2013-05-10 23:30:00", time.Unix(0, 0), 0},
+		{"2013-05-10T20:00:00", "", time.Unix(0, 0), 0},
+	}
+
+	for _, tc := range testCases {
+		actual, duration := eventfulEventTimes(EventfulEvent{StartTime: tc.start, StopTime: tc.stop})
+		if !actual.Equal(tc.time) || duration != tc.duration {
+			t.Errorf("eventfulEventTimes(%q, %q): got %s, %d, wanted %s, %d", tc.start, tc.stop, actual, duration, tc.time, tc.duration)
+		}
+	}
+}
+
+func TestSearchYoutubeVideos(t *testing.T) {
+	client := replayClient()
+	pid := datastore.PidType(config.Search.Youtube.Pid)
+
+	expected := []*datastore.Item{
+		{
+			Id:       itemId("tag:youtube.com,2008:video:J---aiyznGQ"),
+			Pid:      pid,
+			Text:     "Keyboard Cat! - THE ORIGINAL!",
+			Link:     "http://gdata.youtube.com/feeds/api/videos/J---aiyznGQ?v=2",
+			Media:    "video",
+			Image:    "http://i.ytimg.com/vi/J---aiyznGQ/sddefault.jpg",
+			Duration: 54,
+		},
+		{
+			Id:       itemId("tag:youtube.com,2008:video:0Bmhjf0rKe8"),
+			Pid:      pid,
+			Text:     "Surprised Kitty (Original)",
+			Link:     "http://gdata.youtube.com/feeds/api/videos/0Bmhjf0rKe8?v=2",
+			Media:    "video",
+			Image:    "http://i.ytimg.com/vi/0Bmhjf0rKe8/default.jpg",
+			Duration: 17,
+		},
+	}
+
+	page, err := searchYoutubeVidoes(context.Background(), client, SearchQuery{Text: "cats"})
+	checkSearchPage(t, "youtube", page, err, expected, 0)
+}
+
+func TestBestYoutubeThumbnail(t *testing.T) {
+	thumbnail := func(name string) YoutubeThumbnail {
+		return YoutubeThumbnail{URL: name + ".jpg", Name: name}
+	}
+
+	testCases := []struct {
+		thumbnails []YoutubeThumbnail
+		expected   string
+	}{
+		{nil, ""},
+		{[]YoutubeThumbnail{thumbnail("start"), thumbnail("middle")}, ""},
+		{[]YoutubeThumbnail{thumbnail("start"), thumbnail("default")}, "default.jpg"},
+		{[]YoutubeThumbnail{thumbnail("default"), thumbnail("mqdefault")}, "mqdefault.jpg"},
+		{[]YoutubeThumbnail{thumbnail("hqdefault"), thumbnail("mqdefault"), thumbnail("default")}, "hqdefault.jpg"},
+		{[]YoutubeThumbnail{thumbnail("default"), thumbnail("sddefault"), thumbnail("hqdefault")}, "sddefault.jpg"},
+	}
+
+	for i, tc := range testCases {
+		if actual := bestYoutubeThumbnail(tc.thumbnails); actual != tc.expected {
+			t.Errorf("case %d: got %q, wanted %q", i, actual, tc.expected)
+		}
+	}
+}
+
+func TestSearchSongkickEvents(t *testing.T) {
+	client := replayClient()
+	pid := datastore.PidType(config.Search.Songkick.Pid)
+	image := "http://images.sk-static.com/images/media/profile_images/artists/253846/huge_avatar"
+
+	expected := []*datastore.Item{
+		{
+			Id:    itemId("http://www.songkick.com/concerts/11129128-radiohead-at-o2-arena"),
+			Pid:   pid,
+			Event: eventTime("2006-01-02T15:04:05-0700", "2013-10-08T19:30:00+0100"),
+			Text:  "Radiohead at The O2 Arena (October 8, 2013)",
+			Link:  "http://www.songkick.com/concerts/11129128-radiohead-at-o2-arena",
+			Media: "event",
+			Image: image,
+		},
+		{
+			Id:       itemId("http://www.songkick.com/festivals/1234-glastonbury/id/11129300-glastonbury-2014"),
+			Pid:      pid,
+			Event:    eventTime("2006-01-02", "2014-06-25"),
+			Text:     "Glastonbury 2014 / Worthy Farm",
+			Link:     "http://www.songkick.com/festivals/1234-glastonbury/id/11129300-glastonbury-2014",
+			Media:    "event",
+			Image:    image,
+			Duration: 4 * 24 * 60 * 60,
+		},
+	}
+
+	page, err := searchSongkickEvents(context.Background(), client, SearchQuery{Text: "radiohead"})
+	checkSearchPage(t, "songkick", page, err, expected, 0)
+}
+
+func TestSearchSpotifyTracks(t *testing.T) {
+	client := replayClient()
+	pid := datastore.PidType(config.Search.Spotify.Pid)
+
+	expected := []*datastore.Item{
+		{
+			Id:       itemId("spotify:track:3AJwUDP919kvQ9QcozQPxg"),
+			Pid:      pid,
+			Text:     "Yellow / Coldplay",
+			Link:     "spotify:track:3AJwUDP919kvQ9QcozQPxg",
+			Media:    "audio",
+			Image:    "http://o.scdn.co/300/3ajwudp9a1b2c3d4e5f6",
+			Duration: 266,
+		},
+		{
+			Id:       itemId("spotify:track:2CC5Rq4zN6IuvJQKWY3ZfT"),
+			Pid:      pid,
+			Text:     "Yellow Submarine - Remastered / The Beatles",
+			Link:     "spotify:track:2CC5Rq4zN6IuvJQKWY3ZfT",
+			Media:    "audio",
+			Image:    "http://o.scdn.co/300/2cc5rq4za1b2c3d4e5f6",
+			Duration: 158,
+		},
+	}
+
+	page, err := searchSpotifyTracks(context.Background(), client, SearchQuery{Text: "yellow"})
+	checkSearchPage(t, "spotify", page, err, expected, 0)
+}
+
+func TestSearchLastfm(t *testing.T) {
+	client := replayClient()
+	pid := datastore.PidType(config.Search.Lastfm.Pid)
+
+	expected := []*datastore.Item{
+		{
+			Id:    itemId("http://www.last.fm/music/Radiohead/_/Karma+Police"),
+			Pid:   pid,
+			Text:  "Karma Police / Radiohead",
+			Link:  "http://www.last.fm/music/Radiohead/_/Karma+Police",
+			Media: "audio",
+			Image: "http://userserve-ak.last.fm/serve/300x300/88057565.png",
+		},
+		{
+			Id:    itemId("http://www.last.fm/music/Radiohead/_/Karma+Police+(live)"),
+			Pid:   pid,
+			Text:  "Karma Police (live)",
+			Link:  "http://www.last.fm/music/Radiohead/_/Karma+Police+(live)",
+			Media: "audio",
+		},
+		{
+			Id:       itemId("http://www.last.fm/event/3573541+Radiohead+at+Victoria+Park"),
+			Pid:      pid,
+			Event:    eventTime("Mon, 02 Jan 2006 15:04:05", "Tue, 24 Jun 2014 18:00:00"),
+			Text:     "Radiohead / Victoria Park",
+			Link:     "http://www.last.fm/event/3573541+Radiohead+at+Victoria+Park",
+			Media:    "event",
+			Image:    "http://userserve-ak.last.fm/serve/252/4186.jpg",
+			Duration: 5 * 60 * 60,
+		},
+		{
+			Id:    itemId("http://www.last.fm/event/3573600+Radiohead"),
+			Pid:   pid,
+			Event: eventTime("Mon, 02 Jan 2006 15:04:05", "Thu, 26 Jun 2014 20:00:00"),
+			Text:  "Radiohead",
+			Link:  "http://www.last.fm/event/3573600+Radiohead",
+			Media: "event",
+		},
+	}
+
+	page, err := searchLastfm(context.Background(), client, SearchQuery{Text: "radiohead"})
+	checkSearchPage(t, "lastfm", page, err, expected, searchPageSize)
+}
+
+func TestMultiplexedSearchCursor(t *testing.T) {
+	config = DefaultConfig
+	config.Search.Timeout = 50
+
+	page := func(next int) SearchFunc {
+		return func(ctx context.Context, client *http.Client, q SearchQuery) (*SearchPage, error) {
+			return &SearchPage{Items: []*datastore.Item{}, Next: next}, nil
+		}
+	}
+	fail := func(err error) SearchFunc {
+		return func(ctx context.Context, client *http.Client, q SearchQuery) (*SearchPage, error) {
+			return nil, err
+		}
+	}
+	hang := func(ctx context.Context, client *http.Client, q SearchQuery) (*SearchPage, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	providers := []SearchProvider{
+		NewSearchProvider("more", nil, true, nil, page(32)),
+		NewSearchProvider("done", nil, true, nil, page(0)),
+		NewSearchProvider("error", nil, true, nil, fail(fmt.Errorf("failed"))),
+		NewSearchProvider("unavailable", nil, true, nil, fail(ErrProviderUnavailable)),
+		NewSearchProvider("timeout", nil, true, nil, hang),
+	}
+
+	testCases := []struct {
+		cursor   SearchCursor
+		expected SearchCursor
+	}{
+		{nil, SearchCursor{"more": 32}},
+		{
+			SearchCursor{"more": 16, "done": 16, "error": 16, "unavailable": 16, "timeout": 16},
+			SearchCursor{"more": 32, "error": 16, "unavailable": 16, "timeout": 16},
+		},
+		{SearchCursor{"done": 16}, SearchCursor{}},
+		{SearchCursor{"error": 16, "timeout": 16}, SearchCursor{}},
+	}
+
+	for i, tc := range testCases {
+		results := MultiplexedSearch(context.Background(), SearchQuery{Text: "anything"}, providers, tc.cursor)
+
+		next := SearchCursor{}
+		if results.Cursor != "" {
+			var err error
+			if next, err = DecodeSearchCursor(results.Cursor, providers); err != nil {
+				t.Fatalf("case %d: %s", i, err)
+			}
+		}
+
+		if !reflect.DeepEqual(next, tc.expected) {
+			t.Errorf("case %d: got cursor %v, wanted %v", i, next, tc.expected)
+		}
+		if results.More != (len(tc.expected) > 0) {
+			t.Errorf("case %d: got more %v", i, results.More)
+		}
+	}
+
+	// A negative offset is searched as the first page
+	offset := -1
+	paged := NewSearchProvider("paged", nil, true, nil, func(ctx context.Context, client *http.Client, q SearchQuery) (*SearchPage, error) {
+		offset = q.Offset
+		return &SearchPage{Items: []*datastore.Item{}}, nil
+	})
+	MultiplexedSearch(context.Background(), SearchQuery{Text: "anything"}, []SearchProvider{paged}, SearchCursor{"paged": -5})
+	if offset != 0 {
+		t.Errorf("negative cursor offset: got offset %d, wanted 0", offset)
+	}
+}
+
+func TestDecodeSearchCursor(t *testing.T) {
+	providers := []SearchProvider{
+		NewSearchProvider("youtube", nil, true, nil, nil),
+		NewSearchProvider("spotify", nil, true, nil, nil),
+	}
+
+	testCases := []struct {
+		cursor SearchCursor
+		err    bool
+	}{
+		{SearchCursor{"youtube": 16, "spotify": 0}, false},
+		{SearchCursor{"youtube": -5}, true},
+		{SearchCursor{"unknown": 16}, true},
+	}
+
+	for _, tc := range testCases {
+		c, err := DecodeSearchCursor(tc.cursor.Encode(), providers)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: wanted error, got %v", tc.cursor, c)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", tc.cursor, err)
+		} else if !reflect.DeepEqual(c, tc.cursor) {
+			t.Errorf("%v: got %v", tc.cursor, c)
+		}
+	}
+
+	if _, err := DecodeSearchCursor("not a cursor", providers); err == nil {
+		t.Errorf("malformed cursor: wanted error")
+	}
+}
+
+func TestResolveLocation(t *testing.T) {
+	client := replayClient()
+	config.Search.Songkick.Enabled = true
+	config.Search.Songkick.AppKey = "test"
+
+	testCases := []struct {
+		location  *SearchLocation
+		latitude  float64
+		longitude float64
+		err       bool
+	}{
+		{nil, 0, 0, false},
+		{&SearchLocation{Latitude: 48.85, Longitude: 2.35}, 48.85, 2.35, false},
+		{&SearchLocation{Name: "London"}, 51.5078, -0.128, false},
+		{&SearchLocation{Name: "Nowhereville"}, 0, 0, true},
+	}
+
+	for _, tc := range testCases {
+		err := ResolveLocation(context.Background(), client, tc.location)
+		if (err != nil) != tc.err {
+			t.Errorf("%v: got error %v", tc.location, err)
+			continue
+		}
+		if tc.location != nil && (tc.location.Latitude != tc.latitude || tc.location.Longitude != tc.longitude) {
+			t.Errorf("%v: got %f,%f, wanted %f,%f", tc.location, tc.location.Latitude, tc.location.Longitude, tc.latitude, tc.longitude)
+		}
+	}
+
+	// Without songkick the place is left for providers that take names
+	config.Search.Songkick.Enabled = false
+	paris := &SearchLocation{Name: "Paris"}
+	if err := ResolveLocation(context.Background(), client, paris); err != nil {
+		t.Errorf("lookup without songkick: got error %s", err)
+	}
+	if paris.HasCoordinates() || paris.String() != "Paris" {
+		t.Errorf("lookup without songkick: got %v", paris)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"cgl.tideland.biz/applog"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Each login starts a session that is recorded in redis along with the
+// browser and address it was started from. A session cookie is only valid
+// while its session is recorded, in addition to the datastore's own session
+// check, so sessions can be ended from the server. Sessions expire when they
+// have not been used for the configured session duration.
+
+var ErrSessionNotFound = errors.New("Session not found")
+
+// Keys used to sign session cookies. The first signs new cookies and any of
+// them may verify a cookie, so keys can be rotated by adding a new key at the
+// front and removing the oldest once its cookies have expired.
+var (
+	sessionKeys      [][]byte
+	ephemeralSession []byte
+)
+
+func initSessionKeys(c SessionConfig) {
+	sessionKeys = make([][]byte, 0, len(c.Keys))
+	for _, k := range c.Keys {
+		if k != "" {
+			sessionKeys = append(sessionKeys, []byte(k))
+		}
+	}
+
+	if len(sessionKeys) == 0 {
+		// Kept across reloads so that sessions survive them
+		if ephemeralSession == nil {
+			ephemeralSession = make([]byte, 32)
+			rand.Read(ephemeralSession)
+		}
+		applog.Errorf("No session keys configured, using a temporary key. Sessions will end when the server restarts.")
+		sessionKeys = append(sessionKeys, ephemeralSession)
+	}
+}
+
+func sessionSignature(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(config.Web.Session.Cookie + "=" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setSessionCookie sends a session cookie holding value signed with the
+// current session key
+func setSessionCookie(w http.ResponseWriter, value string) {
+	cookie := http.Cookie{
+		Name:     config.Web.Session.Cookie,
+		Value:    value + "|" + sessionSignature(sessionKeys[0], value),
+		Path:     "/",
+		MaxAge:   config.Web.Session.Duration,
+		HttpOnly: true,
+		Secure:   config.Web.Session.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	cookie := http.Cookie{
+		Name:     config.Web.Session.Cookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   config.Web.Session.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+}
+
+// sessionCookieValue returns the value of the request's session cookie. The
+// boolean result is false if there is no cookie or its signature does not
+// match any of the session keys.
+func sessionCookieValue(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(config.Web.Session.Cookie)
+	if err != nil {
+		return "", false
+	}
+
+	sep := strings.LastIndex(cookie.Value, "|")
+	if sep == -1 {
+		return "", false
+	}
+	value, signature := cookie.Value[:sep], cookie.Value[sep+1:]
+
+	for _, key := range sessionKeys {
+		if hmac.Equal([]byte(signature), []byte(sessionSignature(key, value))) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+type Session struct {
+	Id        string            `json:"id"`
+	Pid       datastore.PidType `json:"pid"`
+	UserAgent string            `json:"useragent"`
+	IP        string            `json:"ip"`
+	Created   int64             `json:"created"`
+	LastSeen  int64             `json:"lastseen"`
+	Current   bool              `json:"current"`
+}
+
+func sessionKey(sid string) string {
+	return redisKey("session", sid)
+}
+
+func profileSessionsKey(pid datastore.PidType) string {
+	return redisKey("sessions", string(pid))
+}
+
+// startSession records a new session for pid started by the request and
+// returns its id
+func startSession(pid datastore.PidType, r *http.Request) (string, error) {
+	sid := randomString(18)
+	now := time.Now().Unix()
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HMSET", sessionKey(sid), "pid", pid, "useragent", r.UserAgent(), "ip", clientIP(r), "created", now, "lastseen", now)
+	conn.Send("EXPIRE", sessionKey(sid), config.Web.Session.Duration)
+	conn.Send("SADD", profileSessionsKey(pid), sid)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return "", err
+	}
+	return sid, nil
+}
+
+// touchSession reports whether the session belongs to pid and is still
+// active, recording that it has been used by the request
+func touchSession(pid datastore.PidType, sid string, r *http.Request) (bool, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	owner, err := redis.String(conn.Do("HGET", sessionKey(sid), "pid"))
+	if err != nil {
+		if err == redis.ErrNil {
+			return false, nil
+		}
+		return false, err
+	}
+	if datastore.PidType(owner) != pid {
+		return false, nil
+	}
+
+	conn.Send("MULTI")
+	conn.Send("HMSET", sessionKey(sid), "ip", clientIP(r), "lastseen", time.Now().Unix())
+	conn.Send("EXPIRE", sessionKey(sid), config.Web.Session.Duration)
+	_, err = conn.Do("EXEC")
+	return err == nil, err
+}
+
+// Sessions lists the active sessions of pid, most recently used first. The
+// session with id current is marked as such.
+func Sessions(pid datastore.PidType, current string) ([]*Session, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	sids, err := redis.Strings(conn.Do("SMEMBERS", profileSessionsKey(pid)))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Session, 0, len(sids))
+	for _, sid := range sids {
+		values, err := redis.StringMap(conn.Do("HGETALL", sessionKey(sid)))
+		if err != nil {
+			return nil, err
+		}
+
+		// Expired sessions are removed from the list as they are found
+		if len(values) == 0 {
+			conn.Do("SREM", profileSessionsKey(pid), sid)
+			continue
+		}
+
+		created, _ := strconv.ParseInt(values["created"], 10, 64)
+		lastSeen, _ := strconv.ParseInt(values["lastseen"], 10, 64)
+
+		list = append(list, &Session{
+			Id:        sid,
+			Pid:       datastore.PidType(values["pid"]),
+			UserAgent: values["useragent"],
+			IP:        values["ip"],
+			Created:   created,
+			LastSeen:  lastSeen,
+			Current:   sid == current,
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen > list[j].LastSeen })
+	return list, nil
+}
+
+// RevokeSession ends one of the sessions of pid
+func RevokeSession(pid datastore.PidType, sid string) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	removed, err := redis.Int(conn.Do("SREM", profileSessionsKey(pid), sid))
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrSessionNotFound
+	}
+
+	_, err = conn.Do("DEL", sessionKey(sid))
+	return err
+}
+
+// RevokeSessions ends every session of pid
+func RevokeSessions(pid datastore.PidType) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	sids, err := redis.Strings(conn.Do("SMEMBERS", profileSessionsKey(pid)))
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	for _, sid := range sids {
+		conn.Send("DEL", sessionKey(sid))
+	}
+	conn.Send("DEL", profileSessionsKey(pid))
+	_, err = conn.Do("EXEC")
+	return err
+}
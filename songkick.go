@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	songkickEventsUrl    = "http://api.songkick.com/api/3.0/events.json"
+	songkickLocationsUrl = "http://api.songkick.com/api/3.0/search/locations.json"
+)
+
+type SongkickResponse struct {
+	ResultsPage SongkickResultsPage `json:"resultsPage"`
+}
+
+type SongkickResultsPage struct {
+	Status       string          `json:"status"`
+	Results      SongkickResults `json:"results"`
+	TotalEntries int             `json:"totalEntries"`
+	PerPage      int             `json:"perPage"`
+	Page         int             `json:"page"`
+	Error        *SongkickError  `json:"error"`
+}
+
+type SongkickError struct {
+	Message string `json:"message"`
+}
+
+type SongkickResults struct {
+	Events    []SongkickEvent `json:"event"`
+	Locations []SongkickPlace `json:"location"`
+}
+
+type SongkickEvent struct {
+	ID          int                   `json:"id"`
+	Type        string                `json:"type"`
+	URI         string                `json:"uri"`
+	DisplayName string                `json:"displayName"`
+	Status      string                `json:"status"`
+	Start       SongkickTime          `json:"start"`
+	End         *SongkickTime         `json:"end"`
+	Performance []SongkickPerformance `json:"performance"`
+	Venue       SongkickVenue         `json:"venue"`
+	Location    SongkickLocation      `json:"location"`
+}
+
+type SongkickTime struct {
+	Date     string `json:"date"`
+	Time     string `json:"time"`
+	DateTime string `json:"datetime"`
+}
+
+type SongkickPerformance struct {
+	DisplayName  string         `json:"displayName"`
+	Billing      string         `json:"billing"`
+	BillingIndex int            `json:"billingIndex"`
+	Artist       SongkickArtist `json:"artist"`
+}
+
+type SongkickArtist struct {
+	ID          int    `json:"id"`
+	DisplayName string `json:"displayName"`
+	URI         string `json:"uri"`
+}
+
+type SongkickVenue struct {
+	ID          int    `json:"id"`
+	DisplayName string `json:"displayName"`
+	URI         string `json:"uri"`
+}
+
+type SongkickLocation struct {
+	City string  `json:"city"`
+	Lat  float64 `json:"lat"`
+	Lng  float64 `json:"lng"`
+}
+
+// SongkickPlace is a city matching a location search, and the metro area
+// songkick groups it into
+type SongkickPlace struct {
+	City      SongkickArea `json:"city"`
+	MetroArea SongkickArea `json:"metroArea"`
+}
+
+type SongkickArea struct {
+	DisplayName string  `json:"displayName"`
+	Lat         float64 `json:"lat"`
+	Lng         float64 `json:"lng"`
+}
+
+// Headliner returns the artist billed first for the event, if any
+func (e *SongkickEvent) Headliner() *SongkickArtist {
+	var headliner *SongkickArtist
+	index := 0
+	for i, p := range e.Performance {
+		if headliner == nil || p.BillingIndex < index {
+			headliner = &e.Performance[i].Artist
+			index = p.BillingIndex
+		}
+	}
+	return headliner
+}
+
+// ImageURL returns the songkick hosted profile image for the artist
+func (a *SongkickArtist) ImageURL() string {
+	if a.ID == 0 {
+		return ""
+	}
+	return fmt.Sprintf("http://images.sk-static.com/images/media/profile_images/artists/%d/huge_avatar", a.ID)
+}
+
+// More reports whether there are further pages of results
+func (p *SongkickResultsPage) More() bool {
+	return p.Page*p.PerPage < p.TotalEntries
+}
+
+type SongkickSearchParams struct {
+	ArtistName string
+	Location   string
+	MinDate    time.Time
+	MaxDate    time.Time
+	Page       int
+	PerPage    int
+}
+
+func songkickSearchEvents(ctx context.Context, client *http.Client, appKey string, params SongkickSearchParams) (*SongkickResponse, error) {
+	query := url.Values{}
+	query.Set("apikey", appKey)
+	query.Set("artist_name", params.ArtistName)
+	query.Set("page", strconv.Itoa(params.Page))
+	query.Set("per_page", strconv.Itoa(params.PerPage))
+	if params.Location != "" {
+		query.Set("location", params.Location)
+	}
+	// Songkick requires both ends of a date range
+	if !params.MinDate.IsZero() && !params.MaxDate.IsZero() {
+		query.Set("min_date", params.MinDate.Format("2006-01-02"))
+		query.Set("max_date", params.MaxDate.Format("2006-01-02"))
+	}
+
+	return songkickGet(ctx, client, fmt.Sprintf("%s?%s", songkickEventsUrl, query.Encode()))
+}
+
+// songkickSearchLocations finds the cities whose names match name
+func songkickSearchLocations(ctx context.Context, client *http.Client, appKey string, name string) (*SongkickResponse, error) {
+	query := url.Values{}
+	query.Set("apikey", appKey)
+	query.Set("query", name)
+
+	return songkickGet(ctx, client, fmt.Sprintf("%s?%s", songkickLocationsUrl, query.Encode()))
+}
+
+func songkickGet(ctx context.Context, client *http.Client, rawurl string) (*SongkickResponse, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Songkick returned status %s", resp.Status)
+	}
+
+	results := &SongkickResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(results); err != nil {
+		return nil, err
+	}
+
+	if results.ResultsPage.Error != nil {
+		return nil, fmt.Errorf("Songkick returned error: %s", results.ResultsPage.Error.Message)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Tracks are searched for using the spotify metadata API directly so that the
+// requests can be made with the search providers' http client
+
+const spotifyTrackSearchUrl = "http://ws.spotify.com/search/1/track.json"
+
+type SpotifyTrackSearchResponse struct {
+	Info   SpotifySearchInfo `json:"info"`
+	Tracks []SpotifyTrack    `json:"tracks"`
+}
+
+type SpotifySearchInfo struct {
+	NumResults int `json:"num_results"`
+	Limit      int `json:"limit"`
+	Offset     int `json:"offset"`
+	Page       int `json:"page"`
+}
+
+type SpotifyTrack struct {
+	Name    string          `json:"name"`
+	URI     string          `json:"href"`
+	Length  float64         `json:"length"` // seconds
+	Artists []SpotifyArtist `json:"artists"`
+	Album   SpotifyAlbum    `json:"album"`
+}
+
+type SpotifyArtist struct {
+	Name string `json:"name"`
+	URI  string `json:"href"`
+}
+
+type SpotifyAlbum struct {
+	Name string `json:"name"`
+	URI  string `json:"href"`
+}
+
+// spotifySearchTracks fetches a page of tracks matching srch, counting pages
+// from 1
+func spotifySearchTracks(ctx context.Context, client *http.Client, srch string, page int) (*SpotifyTrackSearchResponse, error) {
+	query := url.Values{}
+	query.Set("q", srch)
+	query.Set("page", strconv.Itoa(page))
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s?%s", spotifyTrackSearchUrl, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Spotify returned status %s", resp.Status)
+	}
+
+	results := &SpotifyTrackSearchResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/placetime/datastore"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Profiles may protect password logins with a time based one time password
+// (RFC 6238) as generated by authenticator apps. Enrolling creates a secret
+// that only takes effect once a code generated from it has been confirmed.
+// Confirming also issues recovery codes, each of which can be used once in
+// place of a code if the authenticator is lost. Only hashes of the recovery
+// codes are stored. Logins through twitter cannot carry a code, so they are
+// held open by a short lived token until the code is posted.
+
+const (
+	totpIssuer   = "Placetime"
+	totpDigits   = 6
+	totpPeriod   = 30
+	totpSkew     = 1 // periods either side of now that are accepted
+	recoveryKeys = 10
+
+	// Seconds a login waiting for its code is held open
+	totpLoginExpiry = 300
+)
+
+var (
+	ErrTOTPNotEnrolled = errors.New("Two factor authentication has not been enrolled")
+	ErrTOTPEnabled     = errors.New("Two factor authentication is already enabled")
+	ErrTOTPInvalid     = errors.New("Invalid two factor authentication code")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+func totpKey(pid datastore.PidType) string {
+	return redisKey("totp", string(pid))
+}
+
+func recoveryCodesKey(pid datastore.PidType) string {
+	return redisKey("totp", string(pid), "recovery")
+}
+
+// totpCode returns the code for the given time step
+func totpCode(secret []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the time step that code was generated for, or -1 if it
+// does not match any step close to now
+func matchTOTP(secret string, code string) int64 {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return -1
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	for counter := now - totpSkew; counter <= now+totpSkew; counter++ {
+		if hmac.Equal([]byte(code), []byte(totpCode(key, counter))) {
+			return counter
+		}
+	}
+	return -1
+}
+
+func hashRecoveryCode(code string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.Replace(code, "-", "", -1))))
+	return hex.EncodeToString(hash[:])
+}
+
+// TOTPEnabled reports whether logins to pid need a second factor
+func TOTPEnabled(pid datastore.PidType) (bool, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	enabled, err := redis.Bool(conn.Do("HGET", totpKey(pid), "enabled"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// EnrollTOTP creates a new secret for pid, replacing any unconfirmed one
+func EnrollTOTP(pid datastore.PidType) (*TOTPEnrollment, error) {
+	enabled, err := TOTPEnabled(pid)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTOTPEnabled
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	secret := totpEncoding.EncodeToString(key)
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("HMSET", totpKey(pid), "secret", secret, "enabled", false, "lastcounter", 0); err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+
+	label := url.PathEscape(totpIssuer + ":" + string(pid))
+
+	return &TOTPEnrollment{
+		Secret: secret,
+		URI:    fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode()),
+	}, nil
+}
+
+// ConfirmTOTP enables two factor authentication for pid if code was
+// generated from its enrolled secret, returning new recovery codes
+func ConfirmTOTP(pid datastore.PidType, code string) ([]string, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	values, err := redis.StringMap(conn.Do("HGETALL", totpKey(pid)))
+	if err != nil {
+		return nil, err
+	}
+	if values["secret"] == "" {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if enabled, _ := strconv.ParseBool(values["enabled"]); enabled {
+		return nil, ErrTOTPEnabled
+	}
+
+	counter := matchTOTP(values["secret"], code)
+	if counter == -1 {
+		return nil, ErrTOTPInvalid
+	}
+
+	if _, err := conn.Do("HMSET", totpKey(pid), "enabled", true, "lastcounter", counter); err != nil {
+		return nil, err
+	}
+
+	return resetRecoveryCodes(conn, pid)
+}
+
+// NewRecoveryCodes replaces the recovery codes of pid with new ones
+func NewRecoveryCodes(pid datastore.PidType) ([]string, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	return resetRecoveryCodes(conn, pid)
+}
+
+// resetRecoveryCodes replaces the recovery codes of pid with new ones
+func resetRecoveryCodes(conn redis.Conn, pid datastore.PidType) ([]string, error) {
+	codes := make([]string, recoveryKeys)
+	args := redis.Args{}.Add(recoveryCodesKey(pid))
+
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+		args = args.Add(hashRecoveryCode(codes[i]))
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", recoveryCodesKey(pid))
+	conn.Send("SADD", args...)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifySecondFactor reports whether code is a current TOTP code or an
+// unused recovery code for pid. Each code is only accepted once.
+func VerifySecondFactor(pid datastore.PidType, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	// Watched so that a code used by two logins at once is only accepted
+	// by the first to record it
+	if _, err := conn.Do("WATCH", totpKey(pid)); err != nil {
+		return false, err
+	}
+
+	values, err := redis.StringMap(conn.Do("HGETALL", totpKey(pid)))
+	if err != nil {
+		conn.Do("UNWATCH")
+		return false, err
+	}
+
+	if counter := matchTOTP(values["secret"], code); counter != -1 {
+		last, _ := strconv.ParseInt(values["lastcounter"], 10, 64)
+		if counter <= last {
+			conn.Do("UNWATCH")
+			return false, nil
+		}
+
+		conn.Send("MULTI")
+		conn.Send("HSET", totpKey(pid), "lastcounter", counter)
+		if _, err := redis.Values(conn.Do("EXEC")); err != nil {
+			// The transaction was aborted by another change to the key
+			if err == redis.ErrNil {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+
+	if _, err := conn.Do("UNWATCH"); err != nil {
+		return false, err
+	}
+
+	removed, err := redis.Int(conn.Do("SREM", recoveryCodesKey(pid), hashRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	return removed == 1, nil
+}
+
+// StartTOTPLogin returns a token standing for a login of pid that has passed
+// its first factor and is waiting for a code
+func StartTOTPLogin(pid datastore.PidType) (string, error) {
+	return issueAccountToken(accountTokenTOTPLogin, pid, "", totpLoginExpiry)
+}
+
+// FinishTOTPLogin returns the pid a login token was issued for. The token is
+// removed so that each waiting login gets a single attempt at its code.
+func FinishTOTPLogin(token string) (datastore.PidType, error) {
+	pid, _, err := consumeAccountToken(accountTokenTOTPLogin, token)
+	return pid, err
+}
+
+// DisableTOTP turns off two factor authentication for pid and removes its
+// secret and recovery codes
+func DisableTOTP(pid datastore.PidType) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", totpKey(pid), recoveryCodesKey(pid))
+	return err
+}
+
+func clearTOTP() error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("KEYS", redisKey("totp", "*")))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if _, err := conn.Do("DEL", key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Search providers make their requests with an http client built from the
+// fixtures configuration. When recording, every response is also saved as a
+// fixture file. When replaying, responses are read from the fixture files and
+// the network is never used, so searches can be run and their items checked
+// offline. Fixtures are named after the request with any credentials removed
+// so they can be recorded and replayed with different keys.
+
+const (
+	FixturesRecord = "record"
+	FixturesReplay = "replay"
+)
+
+// Query parameters that carry credentials
+var fixtureCredentialParams = []string{"api_key", "app_key", "apikey", "key"}
+
+// A Fixture is a recorded response to a request
+type Fixture struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// FixtureTransport records responses to, or replays responses from, fixture
+// files in a directory
+type FixtureTransport struct {
+	Mode string
+	Path string
+
+	// Transport makes the requests being recorded. If nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+func (t *FixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch t.Mode {
+	case FixturesRecord:
+		return t.record(req)
+	case FixturesReplay:
+		return t.replay(req)
+	}
+	return nil, fmt.Errorf("unknown fixtures mode %s", t.Mode)
+}
+
+func (t *FixtureTransport) record(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	fixture := &Fixture{
+		Method: req.Method,
+		URL:    fixtureURL(req.URL),
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Body:   string(body),
+	}
+
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(t.Path, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(t.filename(req), data, 0644); err != nil {
+		return nil, err
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func (t *FixtureTransport) replay(req *http.Request) (*http.Response, error) {
+	data, err := ioutil.ReadFile(t.filename(req))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no fixture recorded for %s %s", req.Method, fixtureURL(req.URL))
+		}
+		return nil, err
+	}
+
+	fixture := &Fixture{}
+	if err := json.Unmarshal(data, fixture); err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", fixture.Status, http.StatusText(fixture.Status)),
+		StatusCode:    fixture.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        fixture.Header,
+		Body:          ioutil.NopCloser(strings.NewReader(fixture.Body)),
+		ContentLength: int64(len(fixture.Body)),
+		Request:       req,
+	}, nil
+}
+
+// filename returns the path of the fixture for a request, named after the
+// host and a hash of the request
+func (t *FixtureTransport) filename(req *http.Request) string {
+	hash := sha1.Sum([]byte(req.Method + " " + fixtureURL(req.URL)))
+	return path.Join(t.Path, fmt.Sprintf("%s-%x.json", req.URL.Host, hash))
+}
+
+// fixtureURL returns the URL with its credentials removed and its query
+// parameters in a consistent order
+func fixtureURL(u *url.URL) string {
+	stripped := *u
+	query := stripped.Query()
+	for _, param := range fixtureCredentialParams {
+		query.Del(param)
+	}
+	stripped.RawQuery = query.Encode()
+	return stripped.String()
+}
+
+// newSearchClient returns the http client used by search providers
+func newSearchClient(c FixturesConfig) *http.Client {
+	if c.Mode == "" {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: &FixtureTransport{Mode: c.Mode, Path: c.Path}}
+}
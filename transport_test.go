@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFixtureURL(t *testing.T) {
+	testCases := []struct {
+		url      string
+		expected string
+	}{
+		{"http://api.example.com/search?q=jazz", "http://api.example.com/search?q=jazz"},
+		{"http://api.example.com/search?q=jazz&api_key=secret", "http://api.example.com/search?q=jazz"},
+		{"http://api.example.com/search?app_key=a&apikey=b&key=c&q=jazz", "http://api.example.com/search?q=jazz"},
+		{"http://api.example.com/search?page=2&q=jazz", "http://api.example.com/search?page=2&q=jazz"},
+		{"http://api.example.com/search?q=jazz&page=2", "http://api.example.com/search?page=2&q=jazz"},
+	}
+
+	for _, tc := range testCases {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatalf("could not parse %s: %s", tc.url, err)
+		}
+		if actual := fixtureURL(u); actual != tc.expected {
+			t.Errorf("fixtureURL(%s): got %s, wanted %s", tc.url, actual, tc.expected)
+		}
+	}
+}
+
+func TestFixtureTransportRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"q":%q}`, r.URL.Query().Get("q"))
+	}))
+
+	get := func(client *http.Client, rawurl string) (string, error) {
+		resp, err := client.Get(rawurl)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("got status %s", resp.Status)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	recorder := &http.Client{Transport: &FixtureTransport{Mode: FixturesRecord, Path: dir}}
+	body, err := get(recorder, server.URL+"/search?q=jazz&api_key=secret")
+	if err != nil {
+		t.Fatalf("record failed: %s", err)
+	}
+	if body != `{"q":"jazz"}` {
+		t.Errorf("recorded body: got %s", body)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d fixture files, wanted 1", len(files))
+	}
+
+	data, err := ioutil.ReadFile(dir + "/" + files[0].Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("fixture contains credentials: %s", data)
+	}
+
+	// Replaying must not touch the network
+	server.Close()
+
+	replayer := &http.Client{Transport: &FixtureTransport{Mode: FixturesReplay, Path: dir}}
+	body, err = get(replayer, server.URL+"/search?api_key=different&q=jazz")
+	if err != nil {
+		t.Fatalf("replay failed: %s", err)
+	}
+	if body != `{"q":"jazz"}` {
+		t.Errorf("replayed body: got %s", body)
+	}
+
+	if _, err := get(replayer, server.URL+"/search?q=blues"); err == nil {
+		t.Errorf("replay of unrecorded request: wanted error")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// The youtube client library only fetches the first page of results so
+// searches are made against the JSON form of the video feed directly
+
+const youtubeVideosUrl = "http://gdata.youtube.com/feeds/api/videos"
+
+type YoutubeResponse struct {
+	Feed YoutubeFeed `json:"feed"`
+}
+
+type YoutubeFeed struct {
+	TotalResults YoutubeText    `json:"openSearch$totalResults"`
+	StartIndex   YoutubeText    `json:"openSearch$startIndex"`
+	Entries      []YoutubeEntry `json:"entry"`
+}
+
+type YoutubeText struct {
+	Value json.RawMessage `json:"$t"`
+}
+
+// String returns the text value, which youtube encodes as either a string
+// or a number
+func (t YoutubeText) String() string {
+	var s string
+	if err := json.Unmarshal(t.Value, &s); err == nil {
+		return s
+	}
+	return string(t.Value)
+}
+
+type YoutubeEntry struct {
+	ID    YoutubeText   `json:"id"`
+	Title YoutubeText   `json:"title"`
+	Links []YoutubeLink `json:"link"`
+	Media YoutubeMedia  `json:"media$group"`
+}
+
+type YoutubeLink struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+type YoutubeMedia struct {
+	Thumbnails []YoutubeThumbnail `json:"media$thumbnail"`
+	Duration   YoutubeDuration    `json:"yt$duration"`
+}
+
+type YoutubeThumbnail struct {
+	URL  string `json:"url"`
+	Name string `json:"yt$name"`
+}
+
+type YoutubeDuration struct {
+	Seconds string `json:"seconds"`
+}
+
+// More reports whether there are further results after this page
+func (f *YoutubeFeed) More() bool {
+	total, _ := strconv.Atoi(f.TotalResults.String())
+	start, _ := strconv.Atoi(f.StartIndex.String())
+	return start-1+len(f.Entries) < total
+}
+
+// youtubeVideoSearch fetches maxResults videos matching srch, starting with
+// the result at startIndex (counted from 1)
+func youtubeVideoSearch(ctx context.Context, client *http.Client, srch string, startIndex int, maxResults int) (*YoutubeFeed, error) {
+	query := url.Values{}
+	query.Set("q", srch)
+	query.Set("v", "2")
+	query.Set("alt", "json")
+	query.Set("start-index", strconv.Itoa(startIndex))
+	query.Set("max-results", strconv.Itoa(maxResults))
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s?%s", youtubeVideosUrl, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Youtube returned status %s", resp.Status)
+	}
+
+	results := &YoutubeResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(results); err != nil {
+		return nil, err
+	}
+
+	return &results.Feed, nil
+}